@@ -1,5 +1,10 @@
 #!/bin/bash
 
+# Pinning the root of trust of the TUF client, when given
+if [ -n "$TUF_ROOT" ]; then
+    cp "$TUF_ROOT" internal/updater/trust/root.json
+fi
+
 # Building the binary that is going to be released 
 GOOS=linux GOARCH=amd64 go build -o bin/nebula-on-premise-linux cmd/general-service/main.go  
 
@@ -11,13 +11,21 @@ current_date=$(date +"%Y.%m.%d")
 
 # Ensure that we are up to date with remote 
 git pull origin main
+# The tags of the releases made elsewhere today are needed to number this one
+git fetch --tags origin
 
 # Get the current commit hash (shortened)
 commit_hash=$(git rev-parse --short HEAD)
 
-# Variable for the tag 
+# Variable for the tag. Later releases of the same day get a sequence number after
+# the date (v2025.03.14.2-sha.1a2b3c4), so that the updater orders them.
 
-tag="v${current_date}-sha.${commit_hash}"
+releases_today=$(git tag --list "v${current_date}-sha.*" "v${current_date}.*-sha.*" | wc -l)
+if [ "$releases_today" -eq 0 ]; then
+  tag="v${current_date}-sha.${commit_hash}"
+else
+  tag="v${current_date}.$((releases_today + 1))-sha.${commit_hash}"
+fi
 
 # Output the future release tag 
 
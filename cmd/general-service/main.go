@@ -24,6 +24,7 @@ func main() {
 
 	// Control aspects of parsing behaviour
 	opts := []ff.Option{
+		ff.WithEnvVarPrefix("GENERAL_SERVICE"),
 		ff.WithConfigFileFlag("config"),
 		ff.WithConfigFileParser(ffyaml.Parse),
 	}
@@ -1,14 +1,21 @@
 package cli
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
 	"sync"
 
 	"github.com/peterbourgon/ff/v4"
 	"github.com/saltosystems-internal/x/log"
 	"github.com/sorayaormazabalmayo/general-service/internal/server"
 	"github.com/sorayaormazabalmayo/general-service/internal/updater"
+	"golang.org/x/term"
 )
 
 // NewGeneralServiceCommand creates and returns the root CLI command.
@@ -27,6 +34,10 @@ func NewGeneralServiceCommand(logger log.Logger) ff.Command {
 			newServeCommand(logger),
 			newUpdateCommand(),
 			newServeAndUpdateCommand(logger),
+			newImportBundleCommand(),
+			newExportBundleCommand(),
+			newRollbackCommand(),
+			newHashPasswordCommand(),
 		},
 	}
 }
@@ -36,15 +47,29 @@ func newServeCommand(logger log.Logger) *ff.Command {
 	// Configuration structure
 	cfg := &server.Config{}
 
-	logger.Info("Config parameters before parsing: ", "httpAddr:", cfg.HTTPAddr, "internal-httpAddr:", cfg.InternatHTTPAddr, "debug:", cfg.Debug)
+	logger.Info("Config parameters before parsing: ", "httpAddr:", cfg.HTTPAddr, "internal-httpAddr:", cfg.InternalHTTPAddr, "debug:", cfg.Debug)
 
 	fs := ff.NewFlagSet("serve")
 	_ = fs.String(0, "config", "", "config file in yaml format")
 	fs.StringVar(&cfg.HTTPAddr, 0, "http-addr", "localhost:8000", "HTTP address")
-	fs.StringVar(&cfg.InternatHTTPAddr, 0, "internal-http-addr", "localhost:9000", "Internal HTTP address")
+	fs.StringVar(&cfg.InternalHTTPAddr, 0, "internal-http-addr", "localhost:9000", "Internal HTTP address of the probes, the metrics and pprof, keep it on localhost (empty to disable)")
+	fs.DurationVar(&cfg.MaxMetadataAge, 0, "max-metadata-age", server.DefaultMaxMetadataAge, "age of the last successful metadata check after which /readyz fails (0 to not check)")
 	fs.BoolVarDefault(&cfg.Debug, 0, "debug", false, "Enable debug")
-	fs.BoolVarDefault(&cfg.AutoUpdate, 0, "auto-update", false, "Enable updater")
-	fs.StringVar(&cfg.MetadataURL, 0, "metadata-url", "https://sorayaormazabalmayo.github.io/TUF_Repository_YubiKey_Vault/metadata", "Metadata URL")
+	fs.BoolVarDefault(&cfg.AutoUpdate, 0, "auto-update", false, "tell the UI that the updater installs releases automatically")
+	fs.StringVar(&cfg.MetadataURL, 0, "metadata-url", updater.DefaultMetadataURL, "Metadata URL")
+	fs.StringVar(&cfg.StatusFile, 0, "status-file", updater.DefaultStatusFile, "update status file shared with the updater")
+	fs.StringVar(&cfg.BundleDir, 0, "bundle-dir", updater.DefaultBundleDir, "directory where uploaded offline update bundles are stored")
+	fs.StringVar(&cfg.InventoryFile, 0, "inventory-file", updater.DefaultInventory, "file listing the installed versions, written by the updater")
+	fs.StringVar(&cfg.RollbackFile, 0, "rollback-file", updater.DefaultRollback, "file where rollbacks are requested to the updater")
+	fs.StringVar(&cfg.ControlSocket, 0, "control-socket", updater.DefaultControlSocket, "Unix socket of the updater control API (empty to only use the status file)")
+	fs.StringVar(&cfg.Service, 0, "service", updater.DefaultService, "service whose updates are shown in the UI")
+	fs.StringVar(&cfg.AccountsFile, 0, "accounts-file", server.DefaultAccountsFile, "file with the admin accounts and API tokens allowed to change the updates")
+	fs.DurationVar(&cfg.SessionTTL, 0, "session-ttl", server.DefaultSessionTTL, "lifetime of the UI sessions")
+	fs.StringListVar(&cfg.CORSOrigins, 0, "cors-origin", "origin allowed to call the server from other pages, e.g. https://nebula.example.com (repeatable, default none)")
+	fs.StringVar(&cfg.TLSCertFile, 0, "tls-cert", "", "TLS certificate of the server, reloaded on change or SIGHUP (default plain HTTP)")
+	fs.StringVar(&cfg.TLSKeyFile, 0, "tls-key", "", "TLS key of the server")
+	fs.StringVar(&cfg.TLSClientCAFile, 0, "tls-client-ca", "", "CA the clients must present a certificate of (mutual TLS)")
+	fs.BoolVarDefault(&cfg.TLSSelfSigned, 0, "tls-self-signed", false, "generate a self-signed certificate at tls-cert and tls-key when missing")
 
 	cmd := &ff.Command{
 		Name:      "serve",
@@ -59,7 +84,8 @@ func newServeCommand(logger log.Logger) *ff.Command {
 
 			logger.Info("General server started",
 				"http-addr", cfg.HTTPAddr,
-				"http-internal-addr", cfg.InternatHTTPAddr,
+				"http-internal-addr", cfg.InternalHTTPAddr,
+				"tls-cert", cfg.TLSCertFile,
 				"debug", cfg.Debug,
 			)
 
@@ -80,37 +106,62 @@ func newServeCommand(logger log.Logger) *ff.Command {
 
 // newUpdateCommand sets the updater.
 func newUpdateCommand() *ff.Command {
+	// Configuration structure
+	cfg := &updater.Config{}
+
 	// Create a flag set for the "update" subcommand.
 	fs := ff.NewFlagSet("update")
+	_ = fs.String(0, "config", "", "config file in yaml format")
+	cfg.RegisterFlags(fs)
+
 	return &ff.Command{
 		Name:      "update",
 		ShortHelp: "Run the updater",
 		Flags:     fs,
 		Exec: func(ctx context.Context, args []string) error {
-			return updater.Run()
+			return updater.Run(ctx, cfg)
 		},
 	}
 }
 
 // newServeAndUpdateCommand runs both serve and update concurrently.
 func newServeAndUpdateCommand(logger log.Logger) *ff.Command {
-	// Create a configuration structure that will be populated from the flags.
+	// Create the configuration structures that will be populated from the flags.
 	cfg := &server.Config{}
+	updaterCfg := &updater.Config{}
 
-	// Create the flag set and declare all flags here.
+	// Create the flag set and declare all flags here. The metadata URL, the status file, the
+	// bundle folder, the inventory and the rollback files, the auto-update mode, the control
+	// socket and the service are shared, so they are only declared by the updater.
 	fs := ff.NewFlagSet("serve-and-update")
 	_ = fs.String(0, "config", "", "config file in yaml format")
 	fs.StringVar(&cfg.HTTPAddr, 0, "http-addr", "localhost:8000", "HTTP address")
-	fs.StringVar(&cfg.InternatHTTPAddr, 0, "internal-http-addr", "localhost:9000", "Internal HTTP address")
+	fs.StringVar(&cfg.InternalHTTPAddr, 0, "internal-http-addr", "localhost:9000", "Internal HTTP address of the probes, the metrics and pprof, keep it on localhost (empty to disable)")
+	fs.DurationVar(&cfg.MaxMetadataAge, 0, "max-metadata-age", server.DefaultMaxMetadataAge, "age of the last successful metadata check after which /readyz fails (0 to not check)")
 	fs.BoolVarDefault(&cfg.Debug, 0, "debug", false, "Enable debug")
-	fs.BoolVarDefault(&cfg.AutoUpdate, 0, "auto-update", false, "Enable updater")
-	fs.StringVar(&cfg.MetadataURL, 0, "metadata-url", "https://sorayaormazabalmayo.github.io/TUF_Repository_YubiKey_Vault/metadata", "Metadata URL")
+	fs.StringVar(&cfg.AccountsFile, 0, "accounts-file", server.DefaultAccountsFile, "file with the admin accounts and API tokens allowed to change the updates")
+	fs.DurationVar(&cfg.SessionTTL, 0, "session-ttl", server.DefaultSessionTTL, "lifetime of the UI sessions")
+	fs.StringListVar(&cfg.CORSOrigins, 0, "cors-origin", "origin allowed to call the server from other pages, e.g. https://nebula.example.com (repeatable, default none)")
+	fs.StringVar(&cfg.TLSCertFile, 0, "tls-cert", "", "TLS certificate of the server, reloaded on change or SIGHUP (default plain HTTP)")
+	fs.StringVar(&cfg.TLSKeyFile, 0, "tls-key", "", "TLS key of the server")
+	fs.StringVar(&cfg.TLSClientCAFile, 0, "tls-client-ca", "", "CA the clients must present a certificate of (mutual TLS)")
+	fs.BoolVarDefault(&cfg.TLSSelfSigned, 0, "tls-self-signed", false, "generate a self-signed certificate at tls-cert and tls-key when missing")
+	updaterCfg.RegisterFlags(fs)
 
 	cmd := &ff.Command{
 		Name:      "serve-and-update",
 		ShortHelp: "Run both serve and update concurrently",
 		Flags:     fs,
 		Exec: func(ctx context.Context, args []string) error {
+			cfg.MetadataURL = updaterCfg.MetadataURL
+			cfg.StatusFile = updaterCfg.StatusFile
+			cfg.BundleDir = updaterCfg.BundleDir
+			cfg.InventoryFile = updaterCfg.InventoryFile
+			cfg.RollbackFile = updaterCfg.RollbackFile
+			cfg.AutoUpdate = updaterCfg.AutoUpdate
+			cfg.ControlSocket = updaterCfg.ControlSocket
+			cfg.Service = updaterCfg.Service
+
 			var wg sync.WaitGroup
 			wg.Add(2)
 
@@ -135,7 +186,7 @@ func newServeAndUpdateCommand(logger log.Logger) *ff.Command {
 			// Launch the updater.
 			go func() {
 				defer wg.Done()
-				if err := updater.Run(); err != nil {
+				if err := updater.Run(ctx, updaterCfg); err != nil {
 					logger.Error("update command error", "error", err)
 				}
 			}()
@@ -147,3 +198,164 @@ func newServeAndUpdateCommand(logger log.Logger) *ff.Command {
 	}
 	return cmd
 }
+
+// newImportBundleCommand verifies and applies an offline update bundle.
+func newImportBundleCommand() *ff.Command {
+	cfg := &updater.Config{}
+
+	fs := ff.NewFlagSet("import-bundle")
+	_ = fs.String(0, "config", "", "config file in yaml format")
+	allowDowngrade := fs.Bool(0, "allow-downgrade", "install the releases of the bundle even if they are older than the installed ones")
+	cfg.RegisterFlags(fs)
+
+	return &ff.Command{
+		Name:      "import-bundle",
+		Usage:     "general-service import-bundle [FLAGS] <bundle.tar.gz>",
+		ShortHelp: "Verify and apply an offline update bundle",
+		Flags:     fs,
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) != 1 {
+				return errors.New("import-bundle requires the path of the bundle")
+			}
+			if err := cfg.Validate(); err != nil {
+				return err
+			}
+			log, logFile, err := updater.SetupLogging(cfg)
+			if err != nil {
+				return err
+			}
+			defer logFile.Close()
+
+			var opts []updater.Option
+			if *allowDowngrade {
+				opts = append(opts, updater.AllowDowngrade())
+			}
+			results, err := updater.ImportBundleFile(ctx, cfg, args[0], log, opts...)
+			for _, res := range results {
+				fmt.Printf("Updated to %s (previous %s)\n", res.Version, res.PreviousVersion)
+			}
+			return err
+		},
+	}
+}
+
+// newExportBundleCommand builds an offline update bundle on a connected machine.
+func newExportBundleCommand() *ff.Command {
+	cfg := &updater.Config{}
+
+	fs := ff.NewFlagSet("export-bundle")
+	_ = fs.String(0, "config", "", "config file in yaml format")
+	cfg.RegisterFlags(fs)
+
+	return &ff.Command{
+		Name:      "export-bundle",
+		Usage:     "general-service export-bundle [FLAGS] <bundle.tar.gz>",
+		ShortHelp: "Download the TUF metadata and the artifacts into an offline update bundle",
+		Flags:     fs,
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) != 1 {
+				return errors.New("export-bundle requires the path of the bundle")
+			}
+			if err := cfg.Validate(); err != nil {
+				return err
+			}
+			log, logFile, err := updater.SetupLogging(cfg)
+			if err != nil {
+				return err
+			}
+			defer logFile.Close()
+
+			out, err := os.Create(args[0])
+			if err != nil {
+				return fmt.Errorf("failed to create bundle: %w", err)
+			}
+			if err := updater.ExportBundle(ctx, cfg, out, log); err != nil {
+				out.Close()
+				os.Remove(args[0])
+				return err
+			}
+			return out.Close()
+		},
+	}
+}
+
+// newRollbackCommand points a service back to one of its retained versions.
+func newRollbackCommand() *ff.Command {
+	cfg := &updater.Config{}
+
+	fs := ff.NewFlagSet("rollback")
+	_ = fs.String(0, "config", "", "config file in yaml format")
+	cfg.RegisterFlags(fs)
+
+	return &ff.Command{
+		Name:      "rollback",
+		Usage:     "general-service rollback [FLAGS] [version]",
+		ShortHelp: "Roll the service back to a retained version (default the previous one)",
+		Flags:     fs,
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) > 1 {
+				return errors.New("rollback takes at most one version")
+			}
+			var version string
+			if len(args) == 1 {
+				version = args[0]
+			}
+			if err := cfg.Validate(); err != nil {
+				return err
+			}
+			log, logFile, err := updater.SetupLogging(cfg)
+			if err != nil {
+				return err
+			}
+			defer logFile.Close()
+
+			// With a services file, --service selects the service to roll back
+			service := cfg.Service
+			if cfg.ServicesFile == "" {
+				service = ""
+			}
+			res, err := updater.RollbackService(ctx, cfg, service, version, log)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Rolled back to %s (previous %s)\n", res.Version, res.PreviousVersion)
+			return nil
+		},
+	}
+}
+
+// newHashPasswordCommand prints the hash of a password to add an admin account to the accounts file.
+func newHashPasswordCommand() *ff.Command {
+	fs := ff.NewFlagSet("hash-password")
+
+	return &ff.Command{
+		Name:      "hash-password",
+		Usage:     "general-service hash-password < password",
+		ShortHelp: "Print the hash of a password read from the terminal or the standard input",
+		Flags:     fs,
+		Exec: func(ctx context.Context, args []string) error {
+			var password string
+			if term.IsTerminal(int(os.Stdin.Fd())) {
+				fmt.Fprint(os.Stderr, "Password: ")
+				b, err := term.ReadPassword(int(os.Stdin.Fd()))
+				fmt.Fprintln(os.Stderr)
+				if err != nil {
+					return err
+				}
+				password = string(b)
+			} else {
+				line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+				if err != nil && !errors.Is(err, io.EOF) {
+					return err
+				}
+				password = strings.TrimRight(line, "\r\n")
+			}
+			hash, err := server.HashPassword(password)
+			if err != nil {
+				return err
+			}
+			fmt.Println(hash)
+			return nil
+		},
+	}
+}
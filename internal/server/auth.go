@@ -0,0 +1,424 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// DefaultAccountsFile is the file listing the admin accounts allowed to change the updates.
+	DefaultAccountsFile = "/etc/nebula-tuf-client/nebula-tuf-accounts.yml"
+	// DefaultSessionTTL is the lifetime of the sessions opened by logging in.
+	DefaultSessionTTL = 12 * time.Hour
+)
+
+const (
+	sessionCookie = "nebula_session"
+	csrfHeader    = "X-CSRF-Token"
+	// maxFailedLogins is the number of failed logins of a user, or from an address, within
+	// failedLoginWindow after which its logins are refused until the window ends.
+	maxFailedLogins   = 5
+	failedLoginWindow = 15 * time.Minute
+)
+
+// accountsFile is the content of the accounts file. Passwords are stored as bcrypt hashes, as
+// printed by the hash-password command, and the bearer tokens of the API clients as the hex
+// SHA-256 of the token.
+type accountsFile struct {
+	Users []struct {
+		Name     string `yaml:"name"`
+		Password string `yaml:"password"`
+	} `yaml:"users"`
+	Tokens []struct {
+		Name   string `yaml:"name"`
+		SHA256 string `yaml:"sha256"`
+	} `yaml:"tokens"`
+}
+
+type session struct {
+	user    string
+	csrf    string
+	expires time.Time
+}
+
+// authenticator authenticates the requests that change the updates: browsers log in with an
+// admin account and send the CSRF token of their session, API clients send a bearer token.
+type authenticator struct {
+	users  map[string][]byte
+	tokens map[[sha256.Size]byte]string
+	ttl    time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*session
+	failures map[string]*loginFailures
+}
+
+// loginFailures counts the failed logins of a user or an address since the first one.
+type loginFailures struct {
+	count int
+	since time.Time
+}
+
+// dummyHash is compared against when the user is unknown, so that the response time does not
+// tell which users exist.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("nebula"), bcrypt.DefaultCost)
+
+// loadAccounts reads the accounts file. Without it no request can change the updates.
+func loadAccounts(path string, ttl time.Duration) (*authenticator, error) {
+	a := &authenticator{
+		users:    map[string][]byte{},
+		tokens:   map[[sha256.Size]byte]string{},
+		ttl:      ttl,
+		sessions: map[string]*session{},
+		failures: map[string]*loginFailures{},
+	}
+	if a.ttl <= 0 {
+		a.ttl = DefaultSessionTTL
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Println("⚠️ No accounts file, updates cannot be changed from the UI:", path)
+		return a, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read accounts file: %w", err)
+	}
+	var file accountsFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse accounts file: %w", err)
+	}
+	for _, u := range file.Users {
+		if u.Name == "" {
+			return nil, errors.New("invalid accounts file: user without name")
+		}
+		if _, err := bcrypt.Cost([]byte(u.Password)); err != nil {
+			return nil, fmt.Errorf("invalid accounts file: password of %s is not a bcrypt hash: %w", u.Name, err)
+		}
+		a.users[u.Name] = []byte(u.Password)
+	}
+	for _, t := range file.Tokens {
+		sum, err := hex.DecodeString(t.SHA256)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid accounts file: token %s is not a hex SHA-256", t.Name)
+		}
+		a.tokens[[sha256.Size]byte(sum)] = t.Name
+	}
+	return a, nil
+}
+
+// HashPassword returns the bcrypt hash of a password, as stored in the accounts file.
+func HashPassword(password string) (string, error) {
+	if password == "" {
+		return "", errors.New("empty password")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// login checks the credentials and opens a session.
+func (a *authenticator) login(user, password string) (string, *session, bool) {
+	hash, ok := a.users[user]
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return "", nil, false
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return "", nil, false
+	}
+
+	s := &session{user: user, csrf: randomToken(), expires: time.Now().Add(a.ttl)}
+	id := randomToken()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for id, s := range a.sessions {
+		if time.Now().After(s.expires) {
+			delete(a.sessions, id)
+		}
+	}
+	a.sessions[id] = s
+	return id, s, true
+}
+
+// loginKeys returns the keys the failed logins of user from the address of r are counted by.
+func loginKeys(r *http.Request, user string) []string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return []string{"user:" + user, "addr:" + host}
+}
+
+// loginBlocked reports whether one of the keys failed to log in too often, and when its
+// logins are allowed again.
+func (a *authenticator) loginBlocked(keys []string) (time.Time, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	var until time.Time
+	for _, key := range keys {
+		f, ok := a.failures[key]
+		if !ok || f.count < maxFailedLogins {
+			continue
+		}
+		if end := f.since.Add(failedLoginWindow); end.After(now) && end.After(until) {
+			until = end
+		}
+	}
+	return until, !until.IsZero()
+}
+
+// loginFailed counts a failed login of the keys. The counts older than failedLoginWindow
+// are dropped, so that the failures of the past windows are forgotten.
+func (a *authenticator) loginFailed(keys []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for key, f := range a.failures {
+		if now.Sub(f.since) >= failedLoginWindow {
+			delete(a.failures, key)
+		}
+	}
+	for _, key := range keys {
+		f, ok := a.failures[key]
+		if !ok {
+			f = &loginFailures{since: now}
+			a.failures[key] = f
+		}
+		f.count++
+	}
+}
+
+// loginSucceeded forgets the failed logins of the keys.
+func (a *authenticator) loginSucceeded(keys []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, key := range keys {
+		delete(a.failures, key)
+	}
+}
+
+// session returns the open session of the request, if any.
+func (a *authenticator) session(r *http.Request) (string, *session, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", nil, false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, ok := a.sessions[cookie.Value]
+	if !ok {
+		return "", nil, false
+	}
+	if time.Now().After(s.expires) {
+		delete(a.sessions, cookie.Value)
+		return "", nil, false
+	}
+	return cookie.Value, s, true
+}
+
+func (a *authenticator) logout(id string) {
+	a.mu.Lock()
+	delete(a.sessions, id)
+	a.mu.Unlock()
+}
+
+// token returns the name of the API client of the bearer token of the request.
+func (a *authenticator) token(r *http.Request) (string, bool, bool) {
+	header := r.Header.Get("Authorization")
+	token, found := strings.CutPrefix(header, "Bearer ")
+	if !found {
+		return "", false, false
+	}
+	name, ok := a.tokens[sha256.Sum256([]byte(token))]
+	return name, true, ok
+}
+
+type userKey struct{}
+
+// requestUser returns the account or the API client that made the request.
+func requestUser(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
+}
+
+// require returns a handler only running next for authenticated requests. Requests
+// authenticated by a session must send its CSRF token, as the browser adds the cookie
+// to the requests of any page.
+func (a *authenticator) require(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, sent, ok := a.token(r)
+		if sent && !ok {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		if !sent {
+			_, s, found := a.session(r)
+			if !found {
+				http.Error(w, "Login required", http.StatusUnauthorized)
+				return
+			}
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeader)), []byte(s.csrf)) != 1 {
+				http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+				return
+			}
+			user = s.user
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+	})
+}
+
+// loginRequest holds the credentials of an admin account.
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// sessionResponse describes the session of the UI, which sends the CSRF token in the
+// X-CSRF-Token header of its requests.
+type sessionResponse struct {
+	Username  string `json:"username"`
+	CSRFToken string `json:"csrf_token"`
+}
+
+// loginHandler returns an HTTP handler that opens a session for the admin account of the body.
+// Only the pages of the server and of the allowed origins can log in, so that another site
+// cannot log a browser into an account of its own, and the body must be JSON, which a
+// cross-site form cannot send. The users and addresses failing too often are refused for a while.
+func loginHandler(a *authenticator, origins []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !sameOrigin(r, origins) {
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return
+		}
+		if mediaType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";"); strings.TrimSpace(mediaType) != "application/json" {
+			http.Error(w, "Login requests must be JSON", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var req loginRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&req); err != nil {
+			http.Error(w, "Invalid login request", http.StatusBadRequest)
+			return
+		}
+		keys := loginKeys(r, req.Username)
+		if until, blocked := a.loginBlocked(keys); blocked {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+			http.Error(w, "Too many failed logins, try again later", http.StatusTooManyRequests)
+			return
+		}
+		id, s, ok := a.login(req.Username, req.Password)
+		if !ok {
+			fmt.Println("⛔ Failed login:", req.Username, r.RemoteAddr)
+			a.loginFailed(keys)
+			http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+			return
+		}
+		a.loginSucceeded(keys)
+
+		fmt.Println("🔑 Logged in:", s.user, r.RemoteAddr)
+		http.SetCookie(w, &http.Cookie{
+			Name:     sessionCookie,
+			Value:    id,
+			Path:     "/",
+			MaxAge:   int(a.ttl.Seconds()),
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteStrictMode,
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sessionResponse{Username: s.user, CSRFToken: s.csrf})
+	}
+}
+
+// sessionHandler returns an HTTP handler describing the session of the request, so that the UI
+// learns its CSRF token after a reload.
+func sessionHandler(a *authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		_, s, ok := a.session(r)
+		if !ok {
+			http.Error(w, "Login required", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sessionResponse{Username: s.user, CSRFToken: s.csrf})
+	}
+}
+
+// logoutHandler returns an HTTP handler that closes the session of the request.
+func logoutHandler(a *authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if id, _, ok := a.session(r); ok {
+			a.logout(id)
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     sessionCookie,
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteStrictMode,
+		})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// sameOrigin reports whether the request comes from a page of the server or of the allowed
+// origins. Requests without Origin, as sent by the API clients, are not from a page.
+func sameOrigin(r *http.Request, origins []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return slices.Contains(origins, strings.ToLower(origin))
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
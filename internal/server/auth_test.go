@@ -0,0 +1,228 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestAuthenticator(t *testing.T) *authenticator {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("api-token"))
+	accounts := "users:\n  - name: admin\n    password: " + string(hash) +
+		"\ntokens:\n  - name: ci\n    sha256: " + hex.EncodeToString(sum[:]) + "\n"
+	path := filepath.Join(t.TempDir(), "accounts.yml")
+	if err := os.WriteFile(path, []byte(accounts), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := loadAccounts(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestLoadAccounts(t *testing.T) {
+	dir := t.TempDir()
+	a, err := loadAccounts(filepath.Join(dir, "missing.yml"), 0)
+	if err != nil || len(a.users) != 0 || len(a.tokens) != 0 || a.ttl != DefaultSessionTTL {
+		t.Fatalf("loadAccounts() without file = %+v, %v", a, err)
+	}
+
+	for name, content := range map[string]string{
+		"plain password": "users:\n  - name: admin\n    password: s3cret\n",
+		"no name":        "users:\n  - password: $2a$04$abcdefghijklmnopqrstuuHn7BHn1E9T9TDNfEWZqLO0p6nJgrrNK\n",
+		"bad token":      "tokens:\n  - name: ci\n    sha256: abc\n",
+	} {
+		path := filepath.Join(dir, strings.ReplaceAll(name, " ", "-")+".yml")
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadAccounts(path, 0); err == nil {
+			t.Errorf("loadAccounts() accepted an accounts file with %s", name)
+		}
+	}
+}
+
+func TestRequire(t *testing.T) {
+	a := newTestAuthenticator(t)
+	id, s, ok := a.login("admin", "s3cret")
+	if !ok {
+		t.Fatal("login failed")
+	}
+	if _, _, ok := a.login("admin", "wrong"); ok {
+		t.Fatal("login with a wrong password succeeded")
+	}
+	if _, _, ok := a.login("nobody", "s3cret"); ok {
+		t.Fatal("login of an unknown user succeeded")
+	}
+	expiredID, expired, _ := a.login("admin", "s3cret")
+	expired.expires = time.Now().Add(-time.Minute)
+
+	handler := a.require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(requestUser(r.Context())))
+	}))
+	tests := []struct {
+		name   string
+		cookie string
+		csrf   string
+		bearer string
+		code   int
+		user   string
+	}{
+		{name: "anonymous", code: http.StatusUnauthorized},
+		{name: "token", bearer: "api-token", code: http.StatusOK, user: "ci"},
+		{name: "invalid token", bearer: "other-token", code: http.StatusUnauthorized},
+		{name: "invalid token with session", bearer: "other-token", cookie: id, csrf: s.csrf, code: http.StatusUnauthorized},
+		{name: "session", cookie: id, csrf: s.csrf, code: http.StatusOK, user: "admin"},
+		{name: "session without CSRF token", cookie: id, code: http.StatusForbidden},
+		{name: "session with wrong CSRF token", cookie: id, csrf: "forged", code: http.StatusForbidden},
+		{name: "session with the CSRF token of another session", cookie: id, csrf: expired.csrf, code: http.StatusForbidden},
+		{name: "expired session", cookie: expiredID, csrf: expired.csrf, code: http.StatusUnauthorized},
+		{name: "unknown session", cookie: "unknown", csrf: s.csrf, code: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/update", nil)
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: sessionCookie, Value: tt.cookie})
+			}
+			if tt.csrf != "" {
+				req.Header.Set(csrfHeader, tt.csrf)
+			}
+			if tt.bearer != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.code {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.code)
+			}
+			if tt.code == http.StatusOK && rec.Body.String() != tt.user {
+				t.Fatalf("user = %q, want %q", rec.Body.String(), tt.user)
+			}
+		})
+	}
+}
+
+func TestLoginSessionLogout(t *testing.T) {
+	a := newTestAuthenticator(t)
+
+	rec := httptest.NewRecorder()
+	loginHandler(a, nil).ServeHTTP(rec, newLoginRequest("s3cret", "http://example.com"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login status = %d", rec.Code)
+	}
+	var login sessionResponse
+	if err := json.NewDecoder(rec.Body).Decode(&login); err != nil || login.Username != "admin" || login.CSRFToken == "" {
+		t.Fatalf("login response = %+v, %v", login, err)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookie || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteStrictMode {
+		t.Fatalf("login cookies = %+v", cookies)
+	}
+
+	// The UI learns the CSRF token of its session after a reload
+	req := httptest.NewRequest(http.MethodGet, "/api/session", nil)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	sessionHandler(a).ServeHTTP(rec, req)
+	var session sessionResponse
+	if err := json.NewDecoder(rec.Body).Decode(&session); err != nil || session != login {
+		t.Fatalf("session response = %+v, %v, want %+v", session, err, login)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/logout", nil)
+	req.AddCookie(cookies[0])
+	logoutHandler(a).ServeHTTP(httptest.NewRecorder(), req)
+	if _, _, ok := a.session(req); ok {
+		t.Fatal("session still open after logout")
+	}
+
+	rec = httptest.NewRecorder()
+	loginHandler(a, nil).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/login", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET login status = %d", rec.Code)
+	}
+}
+
+func newLoginRequest(password, origin string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(`{"username":"admin","password":"`+password+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	return req
+}
+
+func TestLoginCSRF(t *testing.T) {
+	a := newTestAuthenticator(t)
+	origins := []string{"https://ops.example.org"}
+	form := httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(`{"username":"admin","password":"s3cret"}`))
+	form.Header.Set("Content-Type", "text/plain")
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		code int
+	}{
+		{"same origin", newLoginRequest("s3cret", "http://example.com"), http.StatusOK},
+		{"allowed origin", newLoginRequest("s3cret", "https://ops.example.org"), http.StatusOK},
+		{"API client", newLoginRequest("s3cret", ""), http.StatusOK},
+		{"other origin", newLoginRequest("s3cret", "https://evil.example.net"), http.StatusForbidden},
+		{"not JSON", form, http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		loginHandler(a, origins).ServeHTTP(rec, tt.req)
+		if rec.Code != tt.code {
+			t.Errorf("%s: login status = %d, want %d", tt.name, rec.Code, tt.code)
+		}
+	}
+}
+
+func TestLoginLimiter(t *testing.T) {
+	a := newTestAuthenticator(t)
+
+	for i := 0; i < maxFailedLogins; i++ {
+		rec := httptest.NewRecorder()
+		loginHandler(a, nil).ServeHTTP(rec, newLoginRequest("wrong", ""))
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("failed login %d status = %d", i, rec.Code)
+		}
+	}
+	// Even the right password is refused until the window ends
+	rec := httptest.NewRecorder()
+	loginHandler(a, nil).ServeHTTP(rec, newLoginRequest("s3cret", ""))
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("blocked login status = %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	a.mu.Lock()
+	for _, f := range a.failures {
+		f.since = f.since.Add(-failedLoginWindow)
+	}
+	a.mu.Unlock()
+	rec = httptest.NewRecorder()
+	loginHandler(a, nil).ServeHTTP(rec, newLoginRequest("s3cret", ""))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login after the window status = %d", rec.Code)
+	}
+	if len(a.failures) != 0 {
+		t.Fatalf("failures after a successful login = %v", a.failures)
+	}
+}
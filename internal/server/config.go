@@ -1,12 +1,40 @@
 package server
 
+import "time"
+
 // Config holds necessary server configuration parameters
 type Config struct {
-	HTTPAddr         string
-	InternatHTTPAddr string
+	HTTPAddr string
+	// InternalHTTPAddr serves the probes, the metrics and the profiles, empty to disable.
+	InternalHTTPAddr string
 	Debug            bool
-	AutoUpdate       bool
-	MetadataURL      string
+	// AutoUpdate tells the UI that the updater installs the releases without waiting for a click.
+	AutoUpdate  bool
+	MetadataURL string
+	// StatusFile is read and written when the updater does not answer on ControlSocket.
+	StatusFile    string
+	BundleDir     string
+	InventoryFile string
+	// RollbackFile is written with the rollbacks when the updater does not answer on ControlSocket.
+	RollbackFile string
+	// ControlSocket is the control API of the updater.
+	ControlSocket string
+	// Service is the service whose updates the UI shows.
+	Service string
+	// AccountsFile lists the admin accounts and API tokens allowed to change the updates.
+	AccountsFile string
+	SessionTTL   time.Duration
+	// CORSOrigins are the only other origins whose pages may call the server.
+	CORSOrigins []string
+	// TLSCertFile and TLSKeyFile serve the server over TLS.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSClientCAFile requires the clients to present a certificate signed by it.
+	TLSClientCAFile string
+	// TLSSelfSigned generates a self-signed certificate on the first start.
+	TLSSelfSigned bool
+	// MaxMetadataAge is how long after the last successful check of the TUF metadata the server stays ready.
+	MaxMetadataAge time.Duration
 }
 
 // Valid checks if required values are present.
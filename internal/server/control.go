@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/sorayaormazabalmayo/general-service/internal/updater"
+)
+
+// updateControl reaches the updater through its control API. When the updater does not
+// serve it, e.g. an older updater or a disabled socket, the status and rollback files are
+// used instead.
+type updateControl struct {
+	client       *updater.ControlClient
+	service      string
+	statusFile   string
+	rollbackFile string
+}
+
+func newUpdateControl(cfg *Config) *updateControl {
+	c := &updateControl{service: cfg.Service, statusFile: cfg.StatusFile, rollbackFile: cfg.RollbackFile}
+	if cfg.ControlSocket != "" {
+		c.client = updater.NewControlClient(cfg.ControlSocket)
+	}
+	return c
+}
+
+// status returns the update status of the service.
+func (c *updateControl) status(ctx context.Context) (UpdateStatus, error) {
+	s, err := c.serviceStatus(ctx)
+	if err != nil {
+		return UpdateStatus{}, err
+	}
+	return statusFromControl(s), nil
+}
+
+// serviceStatus returns the detailed update status of the service. In file mode it only
+// has the fields of the status file.
+func (c *updateControl) serviceStatus(ctx context.Context) (*updater.ServiceStatus, error) {
+	if c.client != nil {
+		s, err := c.client.Status(ctx, c.service)
+		if err == nil {
+			return s, nil
+		}
+		if !fallbackToFile(err) {
+			return nil, err
+		}
+	}
+	status, err := c.readStatusFile()
+	if err != nil {
+		return nil, err
+	}
+	return &updater.ServiceStatus{
+		Service:         c.service,
+		UpdateAvailable: status.UpdateAvailable == 1,
+		UpdateRequested: status.UpdateRequested == 1,
+		AutomaticUpdate: status.AutomaticUpdate == 1,
+		ScheduledFor:    status.ScheduledFor,
+	}, nil
+}
+
+// apply requests the update of the service.
+func (c *updateControl) apply(ctx context.Context) (UpdateStatus, error) {
+	if c.client != nil {
+		s, err := c.client.Apply(ctx, c.service)
+		if err == nil {
+			return statusFromControl(s), nil
+		}
+		if !fallbackToFile(err) {
+			return UpdateStatus{}, err
+		}
+	}
+	return c.changeStatusFile(func(s *UpdateStatus) {
+		s.UpdateRequested, s.AutomaticUpdate = 1, 0
+	})
+}
+
+// cancel cancels the requested update of the service. In file mode only the queued
+// requests can be cancelled.
+func (c *updateControl) cancel(ctx context.Context) (UpdateStatus, error) {
+	if c.client != nil {
+		s, err := c.client.Cancel(ctx, c.service)
+		if err == nil {
+			return statusFromControl(s), nil
+		}
+		if !fallbackToFile(err) {
+			return UpdateStatus{}, err
+		}
+	}
+	return c.changeStatusFile(func(s *UpdateStatus) {
+		s.UpdateRequested, s.AutomaticUpdate, s.ScheduledFor = 0, 0, ""
+	})
+}
+
+// rollback requests the rollback of the service to version, the previous retained version
+// when empty. The service defaults to the one of the server.
+func (c *updateControl) rollback(ctx context.Context, req rollbackRequest) error {
+	if req.Service == "" {
+		req.Service = c.service
+	}
+	if c.client != nil {
+		_, err := c.client.Rollback(ctx, req.Service, req.Version)
+		if err == nil || !fallbackToFile(err) {
+			return err
+		}
+	}
+	return c.writeRollbackFile(req)
+}
+
+// writeRollbackFile writes req to the rollback file, where the updater picks it up.
+func (c *updateControl) writeRollbackFile(req rollbackRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	// Write next to the file and rename, so the updater never reads a partial request
+	tmp := c.rollbackFile + ".part"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.rollbackFile); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// fallbackToFile reports whether the control API could not be reached, rather than
+// refusing the request.
+func fallbackToFile(err error) bool {
+	var controlErr *updater.ControlError
+	return !errors.As(err, &controlErr)
+}
+
+func statusFromControl(s *updater.ServiceStatus) UpdateStatus {
+	var status UpdateStatus
+	if s.UpdateAvailable {
+		status.UpdateAvailable = 1
+	}
+	if s.UpdateRequested {
+		status.UpdateRequested = 1
+	}
+	if s.AutomaticUpdate {
+		status.AutomaticUpdate = 1
+	}
+	status.ScheduledFor = s.ScheduledFor
+	return status
+}
+
+func (c *updateControl) readStatusFile() (UpdateStatus, error) {
+	var status UpdateStatus
+	data, err := os.ReadFile(c.statusFile)
+	if err != nil {
+		return status, fmt.Errorf("could not read the update status file: %w", err)
+	}
+	if err := json.Unmarshal(data, &status); err != nil {
+		return status, fmt.Errorf("could not parse the update status file: %w", err)
+	}
+	return status, nil
+}
+
+// changeStatusFile applies change to the status file as last written by the updater, so
+// that the fields it owns are kept. The file is locked against the updater meanwhile.
+func (c *updateControl) changeStatusFile(change func(*UpdateStatus)) (UpdateStatus, error) {
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+	unlock, err := updater.LockStatusFile(c.statusFile)
+	if err != nil {
+		return UpdateStatus{}, err
+	}
+	defer unlock()
+
+	status, err := c.readStatusFile()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return status, err
+	}
+	change(&status)
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return status, err
+	}
+	part := filepath.Join(filepath.Dir(c.statusFile), "."+filepath.Base(c.statusFile)+".part")
+	if err := os.WriteFile(part, data, 0644); err != nil {
+		return status, err
+	}
+	if err := os.Rename(part, c.statusFile); err != nil {
+		os.Remove(part)
+		return status, err
+	}
+	updateStatus = status
+	return status, nil
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/sorayaormazabalmayo/general-service/internal/updater"
+)
+
+// Update events pushed to the UI, named after what the updater is doing.
+const (
+	eventIdle        = "idle"
+	eventAvailable   = "available"
+	eventScheduled   = "scheduled"
+	eventChecking    = "checking"
+	eventDownloading = "downloading"
+	eventVerifying   = "verifying"
+	eventInstalling  = "installing"
+	eventRestarting  = "restarting"
+	eventDone        = "done"
+	eventFailed      = "failed"
+)
+
+// eventKeepAlive is the interval between the comments sent to keep idle streams open.
+const eventKeepAlive = 15 * time.Second
+
+// updateEvent is an update event with the status of the service it was derived from.
+type updateEvent struct {
+	Name   string
+	Status *updater.ServiceStatus
+}
+
+// statusHub keeps the last update status and pushes its changes to the event streams.
+type statusHub struct {
+	mu   sync.Mutex
+	last *updater.ServiceStatus
+	subs map[chan updateEvent]struct{}
+}
+
+var updateEvents = &statusHub{subs: map[chan updateEvent]struct{}{}}
+
+// publish pushes status to the streams when it differs from the last one.
+func (h *statusHub) publish(status *updater.ServiceStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if reflect.DeepEqual(h.last, status) {
+		return
+	}
+	event := updateEvent{Name: eventName(h.last, status), Status: status}
+	h.last = status
+	for ch := range h.subs {
+		select {
+		case ch <- event:
+		default:
+			// A slow stream misses intermediate events, the next one carries the whole status
+		}
+	}
+}
+
+// subscribe returns a channel receiving the events and the current status, if already known.
+func (h *statusHub) subscribe() (chan updateEvent, *updater.ServiceStatus, func()) {
+	ch := make(chan updateEvent, 16)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subs[ch] = struct{}{}
+	return ch, h.last, func() {
+		h.mu.Lock()
+		delete(h.subs, ch)
+		h.mu.Unlock()
+	}
+}
+
+// current returns the last update status, nil until read.
+func (h *statusHub) current() *updater.ServiceStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.last
+}
+
+// eventName names the change from the previous status, nil when unknown, to the current one.
+func eventName(prev, cur *updater.ServiceStatus) string {
+	switch {
+	case cur.Applying:
+		switch cur.Phase {
+		case updater.PhaseDownload:
+			return eventDownloading
+		case updater.PhaseVerify:
+			return eventVerifying
+		case updater.PhaseInstall:
+			return eventInstalling
+		case updater.PhaseActivate, updater.PhaseHealth:
+			return eventRestarting
+		default:
+			return eventChecking
+		}
+	case prev != nil && prev.Applying && cur.LastErrorAt != nil && (prev.LastErrorAt == nil || cur.LastErrorAt.After(*prev.LastErrorAt)):
+		return eventFailed
+	case prev != nil && prev.Applying && cur.CurrentVersion != prev.CurrentVersion:
+		return eventDone
+	case cur.UpdateRequested && cur.ScheduledFor != "":
+		return eventScheduled
+	case cur.UpdateAvailable:
+		return eventAvailable
+	default:
+		return eventIdle
+	}
+}
+
+// updateEventsHandler streams the update events to the UI as Server-Sent Events. The stream
+// starts with the current status, so that a client reconnecting after a restart catches up.
+func updateEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	events, current, unsubscribe := updateEvents.subscribe()
+	defer unsubscribe()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	// Browsers reconnect on their own, retry quickly while the service restarts
+	fmt.Fprint(w, "retry: 2000\n\n")
+	if current != nil {
+		if err := writeUpdateEvent(w, updateEvent{Name: eventName(nil, current), Status: current}); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event := <-events:
+			if err := writeUpdateEvent(w, event); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeUpdateEvent(w http.ResponseWriter, event updateEvent) error {
+	data, err := json.Marshal(event.Status)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Name, data)
+	return err
+}
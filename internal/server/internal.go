@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// DefaultMaxMetadataAge is the age of the last successful check of the TUF metadata after which the
+// server is no longer ready.
+const DefaultMaxMetadataAge = time.Hour
+
+// readyTimeout bounds the time the readiness probe waits for the updater.
+const readyTimeout = 2 * time.Second
+
+// httpRequests counts the requests served on the public address.
+var httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "nebula",
+	Name:      "http_requests_total",
+	Help:      "Requests served on the public address, by status code and method.",
+}, []string{"code", "method"})
+
+// newInternalMux returns the routes served on the internal address only: the liveness and readiness
+// probes, the metrics and the profiles of the server.
+func newInternalMux(ctl *updateControl, maxMetadataAge time.Duration) *http.ServeMux {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		&updateCollector{service: ctl.service},
+	)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthHandler)
+	mux.HandleFunc("/readyz", readyHandler(ctl, maxMetadataAge))
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// healthHandler reports that the server is alive.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
+
+// readyResponse is the result of the readiness probe, with the outcome of each check.
+type readyResponse struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// readyHandler returns an HTTP handler reporting whether the server is ready: the updater answers
+// and its last successful check of the TUF metadata is not older than maxMetadataAge, when set.
+// Without the control API only the status file is checked, as the metadata checks are unknown.
+func readyHandler(ctl *updateControl, maxMetadataAge time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		defer cancel()
+
+		res := readyResponse{Ready: true, Checks: map[string]string{}}
+		fail := func(check, msg string) {
+			res.Ready = false
+			res.Checks[check] = msg
+		}
+
+		if ctl.client == nil {
+			if _, err := ctl.readStatusFile(); err != nil && !errors.Is(err, os.ErrNotExist) {
+				fail("updater", err.Error())
+			} else {
+				res.Checks["updater"] = "ok"
+			}
+			res.Checks["metadata"] = "unknown without the control API"
+		} else if status, err := ctl.client.Status(ctx, ctl.service); err != nil {
+			fail("updater", err.Error())
+		} else {
+			res.Checks["updater"] = "ok"
+			switch {
+			case maxMetadataAge <= 0:
+				res.Checks["metadata"] = "not checked"
+			case status.LastSuccessfulCheck == nil:
+				fail("metadata", "no successful check yet")
+			case time.Since(*status.LastSuccessfulCheck) > maxMetadataAge:
+				fail("metadata", fmt.Sprintf("last successful check %s ago", time.Since(*status.LastSuccessfulCheck).Round(time.Second)))
+			default:
+				res.Checks["metadata"] = "ok"
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if !res.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+// updateCollector exports the last update status read from the updater.
+type updateCollector struct {
+	service string
+}
+
+var (
+	updateInfoDesc = prometheus.NewDesc("nebula_update_info",
+		"Versions of the service, current and available.", []string{"service", "current_version", "available_version"}, nil)
+	updateAvailableDesc = prometheus.NewDesc("nebula_update_available",
+		"Whether an update is available.", []string{"service"}, nil)
+	updateRequestedDesc = prometheus.NewDesc("nebula_update_requested",
+		"Whether an update is requested, running or waiting for a maintenance window.", []string{"service"}, nil)
+	updateApplyingDesc = prometheus.NewDesc("nebula_update_applying",
+		"Whether an update is being applied.", []string{"service"}, nil)
+	updateProgressDesc = prometheus.NewDesc("nebula_update_download_progress_ratio",
+		"Share of the artifact downloaded by the running update.", []string{"service"}, nil)
+	lastCheckDesc = prometheus.NewDesc("nebula_update_last_check_timestamp_seconds",
+		"Time of the last check for updates.", []string{"service"}, nil)
+	lastSuccessfulCheckDesc = prometheus.NewDesc("nebula_update_last_successful_check_timestamp_seconds",
+		"Time of the last successful check of the TUF metadata.", []string{"service"}, nil)
+	lastErrorDesc = prometheus.NewDesc("nebula_update_last_error_timestamp_seconds",
+		"Time of the last failed check or update.", []string{"service"}, nil)
+)
+
+func (c *updateCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{updateInfoDesc, updateAvailableDesc, updateRequestedDesc, updateApplyingDesc,
+		updateProgressDesc, lastCheckDesc, lastSuccessfulCheckDesc, lastErrorDesc} {
+		ch <- desc
+	}
+}
+
+func (c *updateCollector) Collect(ch chan<- prometheus.Metric) {
+	status := updateEvents.current()
+	if status == nil {
+		return
+	}
+	gauge := func(desc *prometheus.Desc, value float64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, c.service)
+	}
+	flag := func(desc *prometheus.Desc, value bool) {
+		if value {
+			gauge(desc, 1)
+		} else {
+			gauge(desc, 0)
+		}
+	}
+	timestamp := func(desc *prometheus.Desc, t *time.Time) {
+		if t != nil {
+			gauge(desc, float64(t.UnixNano())/1e9)
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(updateInfoDesc, prometheus.GaugeValue, 1, c.service, status.CurrentVersion, status.AvailableVersion)
+	flag(updateAvailableDesc, status.UpdateAvailable)
+	flag(updateRequestedDesc, status.UpdateRequested)
+	flag(updateApplyingDesc, status.Applying)
+	if status.Progress != nil && status.Progress.Total > 0 {
+		gauge(updateProgressDesc, float64(status.Progress.Done)/float64(status.Progress.Total))
+	}
+	timestamp(lastCheckDesc, status.LastCheck)
+	timestamp(lastSuccessfulCheckDesc, status.LastSuccessfulCheck)
+	timestamp(lastErrorDesc, status.LastErrorAt)
+}
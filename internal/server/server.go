@@ -6,14 +6,20 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/saltosystems-internal/x/log"
 	pkgserver "github.com/saltosystems-internal/x/server"
+	"github.com/sorayaormazabalmayo/general-service/internal/updater"
 )
 
 //go:embed static/index.html
@@ -27,71 +33,294 @@ type Server struct {
 	cancel context.CancelFunc
 }
 
+// UpdateStatus is the update status sent to the UI, as reported by the updater. ScheduledFor is set
+// while a requested update waits for the next maintenance window, and AutomaticUpdate
+// when the update was requested by the auto-update mode. RejectedVersion is the version an operator
+// rolled back from, kept when the status file is written back.
 type UpdateStatus struct {
-	UpdateAvailable int `json:"update_available"`
-	UpdateRequested int `json:"update_requested"`
+	UpdateAvailable int    `json:"update_available"`
+	UpdateRequested int    `json:"update_requested"`
+	AutomaticUpdate int    `json:"automatic_update,omitempty"`
+	ScheduledFor    string `json:"scheduled_for,omitempty"`
+	RejectedVersion string `json:"rejected_version,omitempty"`
 }
 
+// Intervals between refreshes of the update status when no change is notified, and while an update is applied.
+const (
+	statusRefreshInterval   = 30 * time.Second
+	progressRefreshInterval = time.Second
+)
+
 var (
-	jsonFilePath = "/home/sormazabal/src/SALTO-client-linux/update_status.json"
 	updateStatus UpdateStatus
 	updateMutex  sync.Mutex
 )
 
-// readUpdateStatus examinates that update_status.json exists and that can be poperly parsed
-func readUpdateStatus() {
+// refreshUpdateStatus reads the update status from the updater, keeps it for the UI and pushes
+// its changes to the event streams. It returns the kept status and whether an update is being applied.
+func refreshUpdateStatus(ctx context.Context, ctl *updateControl) (UpdateStatus, bool) {
+	status, err := ctl.serviceStatus(ctx)
+	if err != nil {
+		fmt.Println("⚠️ Could not read the update status, keeping the previous one:", err)
+		updateMutex.Lock()
+		defer updateMutex.Unlock()
+		return updateStatus, false
+	}
+	updateEvents.publish(status)
+
 	updateMutex.Lock()
 	defer updateMutex.Unlock()
+	updateStatus = statusFromControl(status)
+	return updateStatus, status.Applying
+}
 
-	file, err := os.ReadFile(jsonFilePath)
-	if err != nil {
-		fmt.Println("⚠️ Could not read update status file, using default (0)")
-		return
+// checkUpdateResponse is the update status sent to the UI, telling it whether releases are also
+// installed automatically.
+type checkUpdateResponse struct {
+	UpdateStatus
+	AutoUpdate bool `json:"auto_update"`
+}
+
+// checkUpdateHandler returns an HTTP handler that responds with the update status as JSON data
+func checkUpdateHandler(autoUpdate bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		updateMutex.Lock()
+		res := checkUpdateResponse{UpdateStatus: updateStatus, AutoUpdate: autoUpdate}
+		updateMutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(res)
 	}
+}
 
-	err = json.Unmarshal(file, &updateStatus)
-	if err != nil {
-		fmt.Println("⚠️ Could not parse update status JSON, using default (0)")
+// updateStatusHandler returns an HTTP handler reporting the detailed update status of the service: the
+// current and available versions, the last checks and errors and the phase of the running update.
+func updateStatusHandler(ctl *updateControl) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		status, err := ctl.serviceStatus(r.Context())
+		if err != nil {
+			http.Error(w, "Could not read the update status", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
 	}
 }
 
-// checkUpdateHandler is an HTTP hanfler function in GO that responds to an HTTP request with JSON data
-func checkUpdateHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(updateStatus)
+// runUpdaterHandler returns an HTTP handler that requests the update to the updater when it retrieves a POST request.
+// The updater applies it right away or queues it for the next maintenance window.
+func runUpdateHandler(ctl *updateControl) http.HandlerFunc {
+	return controlHandler(ctl.apply, "⚙️ Requesting the update...", "Could not request the update")
+}
+
+// cancelUpdateHandler returns an HTTP handler that cancels the requested update when it retrieves a POST request.
+func cancelUpdateHandler(ctl *updateControl) http.HandlerFunc {
+	return controlHandler(ctl.cancel, "🛑 Cancelling the update...", "Could not cancel the update")
 }
 
-// runUpdaterHandler is an HTTP handler that initiated an update process when it retrieves a POST request
-func runUpdateHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
-		return
+// controlHandler runs a request to the updater and responds with the resulting update status.
+// The requests the updater refuses, e.g. when there is no update to cancel, are reported
+// with its status code.
+func controlHandler(action func(context.Context) (UpdateStatus, error), logMsg, errMsg string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		fmt.Printf("%s (%s)\n", logMsg, requestUser(r.Context()))
+		status, err := action(r.Context())
+		if err != nil {
+			var controlErr *updater.ControlError
+			if errors.As(err, &controlErr) {
+				http.Error(w, errMsg+": "+controlErr.Message, controlErr.StatusCode)
+				return
+			}
+			http.Error(w, errMsg, http.StatusInternalServerError)
+			return
+		}
+
+		updateMutex.Lock()
+		updateStatus = status
+		updateMutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(status)
 	}
+}
+
+// versionsHandler returns an HTTP handler listing the installed versions of the services,
+// as written by the updater in the inventory file.
+func versionsHandler(inventoryFile string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		data, err := os.ReadFile(inventoryFile)
+		if errors.Is(err, os.ErrNotExist) {
+			data = []byte("[]")
+		} else if err != nil {
+			http.Error(w, "Could not read the installed versions", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}
+}
+
+// rollbackRequest asks the updater to roll a service back. An empty version stands for
+// the previous retained version, and an empty service for the only configured one.
+type rollbackRequest struct {
+	Service string `json:"service"`
+	Version string `json:"version"`
+}
+
+// rollbackHandler returns an HTTP handler that asks the updater for the rollback requested
+// in the body. The rollback runs in the background, so the handler replies once it is accepted.
+func rollbackHandler(ctl *updateControl) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req rollbackRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&req); err != nil {
+				http.Error(w, "Invalid rollback request", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if err := ctl.rollback(r.Context(), req); err != nil {
+			var controlErr *updater.ControlError
+			if errors.As(err, &controlErr) {
+				http.Error(w, "Could not request the rollback: "+controlErr.Message, controlErr.StatusCode)
+				return
+			}
+			http.Error(w, "Could not request the rollback", http.StatusInternalServerError)
+			return
+		}
+
+		fmt.Println("↩️ Rollback requested", req.Service, req.Version, requestUser(r.Context()))
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// maxBundleUploadSize bounds the size of the offline update bundles uploaded to the server.
+const maxBundleUploadSize = 2 << 30
+
+// importBundleHandler returns an HTTP handler that stores an uploaded offline update bundle in
+// the bundle folder, where the updater verifies and applies it. The bundle is either sent as the
+// "bundle" field of a multipart form or as the raw request body.
+func importBundleHandler(bundleDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBundleUploadSize)
+
+		var body io.Reader = r.Body
+		if mr, err := r.MultipartReader(); err == nil {
+			for {
+				part, err := mr.NextPart()
+				if err != nil {
+					http.Error(w, "Missing bundle field", http.StatusBadRequest)
+					return
+				}
+				if part.FormName() == "bundle" {
+					body = part
+					break
+				}
+			}
+		}
+
+		name := filepath.Join(bundleDir, fmt.Sprintf("%d.tar.gz", time.Now().UnixNano()))
+		if err := saveBundle(name, body); err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				http.Error(w, "Bundle too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Could not store the bundle", http.StatusInternalServerError)
+			return
+		}
 
-	fmt.Println("⚙️ Running update process...")
-	setUpdateRequestedStatus(1)
+		fmt.Println("📦 Offline update bundle uploaded:", name, requestUser(r.Context()))
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
 
-	// handleShutdown waits for a termination signal and shuts down the server
-	// syscall.Kill(syscall.Getpid(), syscall.SIGINT)
-	// Restart the application (or notify an external service manager)
+// saveBundle writes the bundle next to its final name and renames it once complete,
+// so that the updater never picks up a partial upload.
+func saveBundle(name string, body io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0750); err != nil {
+		return err
+	}
+	part := name + ".part"
+	out, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, body); err != nil {
+		out.Close()
+		os.Remove(part)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(part)
+		return err
+	}
+	return os.Rename(part, name)
 }
 
-func periodicUpdateCheck(ctx context.Context) {
+// periodicUpdateCheck refreshes the update status when the updater changes it: through the in-process
+// events when both run in the same process, or the events of its status and journal files otherwise.
+// The status is also refreshed every statusRefreshInterval in case an event is missed.
+func periodicUpdateCheck(ctx context.Context, ctl *updateControl) {
+
+	// The status file lives in the install folder of the service, next to its install journal
+	files, err := updater.WatchFiles(ctx, ctl.statusFile, filepath.Join(filepath.Dir(ctl.statusFile), updater.JournalFileName))
+	if err != nil {
+		fmt.Println("⚠️ Could not watch the update status file, polling it:", err)
+	}
+	events, unsubscribe := updater.SubscribeStatus()
+	defer unsubscribe()
 
-	// A ticker is used to perform a specific action at a specific interval
-	// It repeatedly sends a signal on a channel ticker.C
-	ticker := time.NewTicker(1 * time.Second)
+	// A timer is used to refresh the status when no change is notified. It is refreshed often while an update
+	// is applied, as the progress of an updater running in another process is not notified.
+	timer := time.NewTimer(statusRefreshInterval)
 
-	// This ensures that the ticker stops when the function exists, preventing memory leacks
-	defer ticker.Stop()
+	// This ensures that the timer stops when the function exists, preventing memory leacks
+	defer timer.Stop()
+	var available bool
 	for {
+		status, applying := refreshUpdateStatus(ctx, ctl)
+		if status.UpdateAvailable == 1 && !available {
+			fmt.Println("🔄 Update available! Notifying frontend.")
+		}
+		available = status.UpdateAvailable == 1
+
+		timer.Stop()
+		if applying {
+			timer.Reset(progressRefreshInterval)
+		} else {
+			timer.Reset(statusRefreshInterval)
+		}
+
 		select {
-		case <-ticker.C:
-			readUpdateStatus()
-			if updateStatus.UpdateAvailable == 1 {
-				fmt.Println("🔄 Update available! Notifying frontend.")
-			}
+		case <-timer.C:
+		case <-files:
+		case <-events:
 		case <-ctx.Done():
 			fmt.Println("🛑 Stopping periodic update check...")
 			return
@@ -99,32 +328,44 @@ func periodicUpdateCheck(ctx context.Context) {
 	}
 }
 
-// corsMiddleware enables CORS (Cross-origin Resource Sharing) for an HTTP server.
-func corsMiddleware(next http.Handler) http.Handler {
+// corsMiddleware enables CORS (Cross-origin Resource Sharing) for the allowed origins only, so that
+// other web pages cannot read the responses of the server.
+func corsMiddleware(origins []string, next http.Handler) http.Handler {
+	allowed := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		allowed[origin] = true
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusOK)
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		if origin != "" && allowed[origin] {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, "+csrfHeader)
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if !allowed[origin] {
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
 			return
 		}
 		next.ServeHTTP(w, r)
 	})
 }
 
-// Setting "update_requested" to a value
-func setUpdateRequestedStatus(value int) error {
-	updateMutex.Lock()
-	defer updateMutex.Unlock()
-
-	updateStatus.UpdateRequested = value
-	file, err := json.MarshalIndent(updateStatus, "", "  ")
-	if err != nil {
-		return err
+// parseOrigins checks the allowed CORS origins, given as scheme://host[:port].
+func parseOrigins(origins []string) ([]string, error) {
+	var parsed []string
+	for _, origin := range origins {
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+			return nil, fmt.Errorf("invalid CORS origin %q, expected scheme://host[:port]", origin)
+		}
+		parsed = append(parsed, u.Scheme+"://"+strings.ToLower(u.Host))
 	}
-
-	return os.WriteFile(jsonFilePath, file, 0644)
+	return parsed, nil
 }
 
 // NewServer brings up the server
@@ -137,6 +378,33 @@ func NewServer(cfg *Config, logger log.Logger) (*Server, error) {
 	if cfg.HTTPAddr == "" {
 		return nil, errors.New("invalid config: HTTPAddr missing")
 	}
+	if cfg.StatusFile == "" {
+		return nil, errors.New("invalid config: StatusFile missing")
+	}
+	if cfg.BundleDir == "" {
+		return nil, errors.New("invalid config: BundleDir missing")
+	}
+	if cfg.InventoryFile == "" {
+		return nil, errors.New("invalid config: InventoryFile missing")
+	}
+	if cfg.RollbackFile == "" {
+		return nil, errors.New("invalid config: RollbackFile missing")
+	}
+	if cfg.InternalHTTPAddr != "" && cfg.InternalHTTPAddr == cfg.HTTPAddr {
+		return nil, errors.New("invalid config: InternalHTTPAddr must differ from HTTPAddr")
+	}
+	if err := cfg.validateTLS(); err != nil {
+		return nil, err
+	}
+	origins, err := parseOrigins(cfg.CORSOrigins)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	auth, err := loadAccounts(cfg.AccountsFile, cfg.SessionTTL)
+	if err != nil {
+		return nil, err
+	}
+
 	// The mux variable in this code is an HTTP request multiplexer created using http.NewServeMux().
 	// It is responsible for routing incoming HTTP requests to the correct handler functions based on the request URL.
 	mux := http.NewServeMux()
@@ -156,22 +424,55 @@ func NewServer(cfg *Config, logger log.Logger) (*Server, error) {
 		w.Write(data)
 	})
 
-	mux.HandleFunc("/check-update", checkUpdateHandler)
-	mux.HandleFunc("/run-update", runUpdateHandler)
+	ctl := newUpdateControl(cfg)
+	mux.HandleFunc("/check-update", checkUpdateHandler(cfg.AutoUpdate))
+	mux.HandleFunc("/api/v1/update/status", updateStatusHandler(ctl))
+	mux.HandleFunc("/api/v1/update/events", updateEventsHandler)
+	mux.HandleFunc("/api/versions", versionsHandler(cfg.InventoryFile))
 
-	wrappedMux := corsMiddleware(mux)
+	// The requests changing the updates restart the service, so they need an admin account or an API token
+	mux.HandleFunc("/api/v1/login", loginHandler(auth, origins))
+	mux.HandleFunc("/api/v1/session", sessionHandler(auth))
+	mux.Handle("/api/v1/logout", auth.require(logoutHandler(auth)))
+	mux.Handle("/run-update", auth.require(runUpdateHandler(ctl)))
+	mux.Handle("/cancel-update", auth.require(cancelUpdateHandler(ctl)))
+	mux.Handle("/import-bundle", auth.require(importBundleHandler(cfg.BundleDir)))
+	mux.Handle("/api/rollback", auth.require(rollbackHandler(ctl)))
+
+	wrappedMux := promhttp.InstrumentHandlerCounter(httpRequests, corsMiddleware(origins, mux))
 	ctx, cancel := context.WithCancel(context.Background())
-	go periodicUpdateCheck(ctx)
+	go periodicUpdateCheck(ctx, ctl)
 
-	httpServerOpts = append(httpServerOpts, pkgserver.WithRoutes(
-		&pkgserver.Route{Pattern: "/", Handler: wrappedMux},
-	))
-	httpServer, err := pkgserver.NewHTTPServer(cfg.HTTPAddr, httpServerOpts...)
-	if err != nil {
-		cancel()
-		return nil, err
+	if cfg.tlsEnabled() {
+		reloader, err := newCertReloader(cfg)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		servers = append(servers, newTLSServer(cfg.HTTPAddr, wrappedMux, reloader))
+	} else {
+		httpServerOpts = append(httpServerOpts, pkgserver.WithRoutes(
+			&pkgserver.Route{Pattern: "/", Handler: wrappedMux},
+		))
+		httpServer, err := pkgserver.NewHTTPServer(cfg.HTTPAddr, httpServerOpts...)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		servers = append(servers, httpServer)
+	}
+
+	// The probes, the metrics and the profiles are only served on the internal address
+	if cfg.InternalHTTPAddr != "" {
+		internalServer, err := pkgserver.NewHTTPServer(cfg.InternalHTTPAddr, pkgserver.WithRoutes(
+			&pkgserver.Route{Pattern: "/", Handler: newInternalMux(ctl, cfg.MaxMetadataAge)},
+		))
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		servers = append(servers, internalServer)
 	}
-	servers = append(servers, httpServer)
 
 	s, err := pkgserver.NewGroupServer(context.Background(), pkgserver.WithServers(servers))
 	if err != nil {
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sorayaormazabalmayo/general-service/internal/updater"
+)
+
+// selfSignedValidity is the validity of the certificates generated by the self-signed mode.
+const selfSignedValidity = 2 * 365 * 24 * time.Hour
+
+// tlsEnabled reports whether the server is served over TLS.
+func (c *Config) tlsEnabled() bool {
+	return c.TLSCertFile != "" || c.TLSKeyFile != "" || c.TLSSelfSigned
+}
+
+// validateTLS checks the TLS parameters: a certificate and a key, also needed by the self-signed mode
+// to persist the certificate it generates, and a client CA only with them.
+func (c *Config) validateTLS() error {
+	if !c.tlsEnabled() {
+		if c.TLSClientCAFile != "" {
+			return errors.New("invalid config: TLSClientCAFile needs TLSCertFile and TLSKeyFile")
+		}
+		return nil
+	}
+	if c.TLSCertFile == "" || c.TLSKeyFile == "" {
+		return errors.New("invalid config: TLS needs both TLSCertFile and TLSKeyFile")
+	}
+	return nil
+}
+
+// certReloader keeps the TLS configuration of the server, loaded again when the certificate, the key or the
+// client CA change or on SIGHUP, so that renewed certificates are served without a restart.
+type certReloader struct {
+	certFile, keyFile, clientCAFile string
+	config                          atomic.Pointer[tls.Config]
+}
+
+func newCertReloader(cfg *Config) (*certReloader, error) {
+	r := &certReloader{certFile: cfg.TLSCertFile, keyFile: cfg.TLSKeyFile, clientCAFile: cfg.TLSClientCAFile}
+	if cfg.TLSSelfSigned {
+		if err := ensureSelfSigned(r.certFile, r.keyFile); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// tlsConfig returns the configuration of the listener, which takes the current one on each handshake.
+func (r *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.config.Load(), nil
+		},
+	}
+}
+
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if r.clientCAFile != "" {
+		data, err := os.ReadFile(r.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read TLS client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("failed to load TLS client CA: no certificate in %s", r.clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	r.config.Store(config)
+	return nil
+}
+
+// watch reloads the configuration until ctx is done. A configuration that fails to load, e.g. while
+// the certificate is written but not yet its key, is logged and the previous one kept.
+func (r *certReloader) watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	paths := []string{r.certFile, r.keyFile}
+	if r.clientCAFile != "" {
+		paths = append(paths, r.clientCAFile)
+	}
+	files, err := updater.WatchFiles(ctx, paths...)
+	if err != nil {
+		fmt.Println("⚠️ Could not watch the TLS certificate, reload it with SIGHUP:", err)
+	}
+
+	for {
+		select {
+		case <-hup:
+		case <-files:
+		case <-ctx.Done():
+			return
+		}
+		if err := r.reload(); err != nil {
+			fmt.Println("⚠️ Could not reload the TLS certificate, keeping the previous one:", err)
+			continue
+		}
+		fmt.Println("🔐 TLS certificate reloaded")
+	}
+}
+
+// ensureSelfSigned generates a self-signed certificate for the names and addresses of the host when
+// there is none yet, so that the server is reached over TLS from the first start. It is kept across
+// restarts, for the browsers to trust it once.
+func ensureSelfSigned(certFile, keyFile string) error {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if certErr == nil && keyErr == nil {
+		return nil
+	}
+	if !errors.Is(certErr, os.ErrNotExist) && certErr != nil {
+		return fmt.Errorf("failed to read TLS certificate: %w", certErr)
+	}
+	if !errors.Is(keyErr, os.ErrNotExist) && keyErr != nil {
+		return fmt.Errorf("failed to read TLS key: %w", keyErr)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate TLS key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("failed to generate TLS certificate: %w", err)
+	}
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname != "" && hostname != "localhost" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	// The LAN addresses of the host, the server is usually reached by address
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+				template.IPAddresses = append(template.IPAddresses, ipNet.IP)
+			}
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("failed to generate TLS certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to encode TLS key: %w", err)
+	}
+
+	if err := writePEM(keyFile, "PRIVATE KEY", keyDER, 0600); err != nil {
+		return fmt.Errorf("failed to write TLS key: %w", err)
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return fmt.Errorf("failed to write TLS certificate: %w", err)
+	}
+	fmt.Println("🔐 Generated a self-signed TLS certificate:", certFile)
+	return nil
+}
+
+// writePEM writes a PEM block next to the file and renames it once complete.
+func writePEM(name, blockType string, der []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0750); err != nil {
+		return err
+	}
+	part := filepath.Join(filepath.Dir(name), "."+filepath.Base(name)+".part")
+	if err := os.WriteFile(part, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), perm); err != nil {
+		return err
+	}
+	if err := os.Rename(part, name); err != nil {
+		os.Remove(part)
+		return err
+	}
+	return nil
+}
+
+// tlsServer serves the routes of the server over TLS.
+type tlsServer struct {
+	srv      *http.Server
+	reloader *certReloader
+}
+
+func newTLSServer(addr string, handler http.Handler, reloader *certReloader) *tlsServer {
+	return &tlsServer{
+		srv: &http.Server{
+			Addr:              addr,
+			Handler:           handler,
+			TLSConfig:         reloader.tlsConfig(),
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+		reloader: reloader,
+	}
+}
+
+// Run serves until ctx is done, reloading the certificate when it changes.
+func (s *tlsServer) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go s.reloader.watch(ctx)
+
+	ln, err := net.Listen("tcp", s.srv.Addr)
+	if err != nil {
+		return err
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.srv.Serve(tls.NewListener(ln, s.srv.TLSConfig))
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	if err := s.srv.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package updater
+
+// Auto-update policies, selecting the releases installed without a user request and when.
+// The updates requested by the user always wait for the maintenance windows.
+const (
+	// AutoUpdateAll installs every new release as soon as it is found.
+	AutoUpdateAll = "all"
+	// AutoUpdateCritical only installs the releases marked critical in their index, as soon
+	// as they are found.
+	AutoUpdateCritical = "critical"
+	// AutoUpdateWindow installs every new release in the next maintenance window, and
+	// requires maintenance windows.
+	AutoUpdateWindow = "window"
+)
+
+// autoUpdates reports whether the release of index is installed automatically.
+func (c *Config) autoUpdates(index *IndexInfo) bool {
+	if !c.AutoUpdate {
+		return false
+	}
+	if c.AutoUpdatePolicy == AutoUpdateCritical {
+		return index.Critical
+	}
+	return true
+}
+
+// waitsForWindow reports whether the requested update of status is only applied inside
+// the maintenance windows. Only the window policy defers the automatic updates.
+func (c *Config) waitsForWindow(status UpdateStatus) bool {
+	return status.AutomaticUpdate != 1 || c.AutoUpdatePolicy == AutoUpdateWindow
+}
+
+// requestAutoUpdate requests the update of the checked release as if the user did, unless
+// the release is not covered by the auto-update policy, already failed to install
+// automatically or is not newer than the version an operator rolled back from. It reports
+// whether the update was requested.
+func (u *Updater) requestAutoUpdate(res *CheckResult) (bool, error) {
+	if !u.cfg.autoUpdates(&res.Index) {
+		return false, nil
+	}
+	u.mu.Lock()
+	failed := u.autoFailed == res.Index.Version
+	u.mu.Unlock()
+	if failed {
+		return false, nil
+	}
+	status, err := readUpdateStatus(u.svc.StatusFile)
+	if err != nil {
+		return false, err
+	}
+	if rejected(status.RejectedVersion, res.Index.Version) {
+		return false, nil
+	}
+
+	err = updateStatusFile(u.svc.StatusFile, func(s *UpdateStatus) {
+		s.UpdateAvailable = 1
+		s.UpdateRequested = 1
+		s.AutomaticUpdate = 1
+		// A newer release replaces the rejected one
+		s.RejectedVersion = ""
+	})
+	return err == nil, err
+}
+
+// rejected reports whether the version is not newer than the rejected one.
+func rejected(rejectedVersion, version string) bool {
+	if rejectedVersion == "" {
+		return false
+	}
+	r, err := ParseVersion(rejectedVersion)
+	if err != nil {
+		return false
+	}
+	v, err := ParseVersion(version)
+	if err != nil {
+		return true
+	}
+	return !v.Newer(r)
+}
+
+// autoUpdateFailed keeps the release that failed to install automatically, so that it is
+// not retried on every check. The user can still request it.
+func (u *Updater) autoUpdateFailed(version string) {
+	if version == "" {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.autoFailed = version
+}
+
+// rejectVersion records the version an operator rolled back from, in memory and in the status
+// file so that it survives a restart, so that auto-update does not install it again until a
+// newer release appears. The caller holds u.mu.
+func (u *Updater) rejectVersion(version string) {
+	if version == "" {
+		return
+	}
+	u.autoFailed = version
+	err := updateStatusFile(u.svc.StatusFile, func(s *UpdateStatus) {
+		s.RejectedVersion = version
+	})
+	if err != nil {
+		u.log.Error(err, "Error recording the rejected version", "service", u.svc.Name, "version", version)
+	}
+}
@@ -0,0 +1,42 @@
+package updater
+
+import "testing"
+
+func TestRejected(t *testing.T) {
+	tests := []struct {
+		rejected, version string
+		want              bool
+	}{
+		{"", "v2025.03.14-sha.1a2b3c4", false},
+		{"v2025.03.14-sha.1a2b3c4", "v2025.03.14-sha.1a2b3c4", true},
+		{"v2025.03.14.2-sha.1a2b3c4", "v2025.03.14-sha.5d6e7f8", true},
+		{"v2025.03.14-sha.1a2b3c4", "v2025.03.14.2-sha.5d6e7f8", false},
+		{"v2025.03.14-sha.1a2b3c4", "v2025.03.15-sha.5d6e7f8", false},
+		{"v2025.03.14-sha.1a2b3c4", "latest", true},
+	}
+	for _, tt := range tests {
+		if got := rejected(tt.rejected, tt.version); got != tt.want {
+			t.Errorf("rejected(%q, %q) = %v, want %v", tt.rejected, tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestWaitsForWindow(t *testing.T) {
+	tests := []struct {
+		policy    string
+		automatic int
+		want      bool
+	}{
+		{AutoUpdateAll, 0, true},
+		{AutoUpdateAll, 1, false},
+		{AutoUpdateCritical, 1, false},
+		{AutoUpdateWindow, 0, true},
+		{AutoUpdateWindow, 1, true},
+	}
+	for _, tt := range tests {
+		c := &Config{AutoUpdate: true, AutoUpdatePolicy: tt.policy}
+		if got := c.waitsForWindow(UpdateStatus{UpdateRequested: 1, AutomaticUpdate: tt.automatic}); got != tt.want {
+			t.Errorf("%s policy, automatic %d: waitsForWindow() = %v, want %v", tt.policy, tt.automatic, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,529 @@
+package updater
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+	"github.com/theupdateframework/go-tuf/v2/metadata/fetcher"
+)
+
+// Layout of an offline update bundle: a gzipped tarball holding the TUF metadata and
+// targets as they are laid out in the repository, and the artifact of each service.
+const (
+	bundleMetadataDir  = "metadata"
+	bundleTargetsDir   = "targets"
+	bundleArtifactsDir = "artifacts"
+
+	// MaxBundleSize bounds the size of the files extracted from a bundle.
+	MaxBundleSize = 2 << 30
+)
+
+// Bundle is an offline update bundle extracted to a local folder. The hashes of the
+// extracted files are computed while extracting them.
+type Bundle struct {
+	dir string
+
+	mu     sync.Mutex
+	hashes map[string]string
+}
+
+// ExtractBundle extracts the bundle read from r into dir, which must not exist.
+func ExtractBundle(r io.Reader, dir string) (*Bundle, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle: %w", err)
+	}
+	defer gz.Close()
+
+	if err := os.Mkdir(dir, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create bundle folder: %w", err)
+	}
+	b := &Bundle{dir: dir, hashes: map[string]string{}}
+
+	var total int64
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			b.Close()
+			return nil, fmt.Errorf("failed to read bundle: %w", err)
+		}
+
+		name := path.Clean(hdr.Name)
+		if !filepath.IsLocal(name) {
+			b.Close()
+			return nil, fmt.Errorf("illegal file path in bundle: %s", hdr.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0750); err != nil {
+				b.Close()
+				return nil, err
+			}
+		case tar.TypeReg:
+			total += hdr.Size
+			if total > MaxBundleSize {
+				b.Close()
+				return nil, fmt.Errorf("bundle is larger than %d bytes", MaxBundleSize)
+			}
+			hash, err := writeBundleFile(target, io.LimitReader(tr, hdr.Size))
+			if err != nil {
+				b.Close()
+				return nil, err
+			}
+			b.hashes[target] = hash
+		default:
+			b.Close()
+			return nil, fmt.Errorf("unsupported file type in bundle: %s", hdr.Name)
+		}
+	}
+	return b, nil
+}
+
+// writeBundleFile extracts the file read from r to target and returns its hex encoded sha256.
+func writeBundleFile(target string, r io.Reader) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(target), 0750); err != nil {
+		return "", err
+	}
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return "", fmt.Errorf("failed to extract bundle file: %w", err)
+	}
+	defer out.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, hasher), r); err != nil {
+		return "", fmt.Errorf("failed to extract bundle file: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// Close removes the extracted bundle.
+func (b *Bundle) Close() error {
+	return os.RemoveAll(b.dir)
+}
+
+// artifactPath returns the location of the artifact of the service in the bundle.
+func (b *Bundle) artifactPath(service string) string {
+	return filepath.Join(b.dir, bundleArtifactsDir, service+".zip")
+}
+
+// targetPath returns the location in the bundle of a target given its path relative to the targets URL.
+func (b *Bundle) targetPath(remotePath string) string {
+	return filepath.Join(b.dir, bundleTargetsDir, filepath.FromSlash(remotePath))
+}
+
+// artifactFile returns the location in the bundle of the artifact of the service, stored
+// with the targets when it is published as the TUF target.
+func (b *Bundle) artifactFile(service string, target *ArtifactTarget) string {
+	if target != nil {
+		return b.targetPath(target.RemotePath)
+	}
+	return b.artifactPath(service)
+}
+
+// take moves the extracted file name to dst and returns its hash, so that an artifact is
+// not copied and hashed again. It reports false when the file was not extracted with the
+// given size or cannot be moved, e.g. to another file system, and is to be copied instead.
+func (b *Bundle) take(name, dst string, size int64) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	hash, ok := b.hashes[name]
+	if !ok {
+		return "", false
+	}
+	if info, err := os.Stat(name); err != nil || info.Size() != size {
+		return "", false
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
+		return "", false
+	}
+	if err := os.Rename(name, dst); err != nil {
+		return "", false
+	}
+	delete(b.hashes, name)
+	return hash, true
+}
+
+// hasService reports whether the bundle carries a release of the service: either its
+// artifact or, for artifacts published as TUF targets, its index.
+func (b *Bundle) hasService(svc *ServiceConfig) bool {
+	if _, err := os.Stat(b.artifactPath(svc.Name)); err == nil {
+		return true
+	}
+	if svc.ArtifactTarget == "" {
+		return false
+	}
+	dir, base := path.Split(svc.Index)
+	indexes, _ := filepath.Glob(b.targetPath(dir + "*." + base))
+	return len(indexes) > 0
+}
+
+// fetcher returns a TUF fetcher that serves the metadata and targets of the bundle
+// in place of the remote repository configured in cfg.
+func (b *Bundle) fetcher(cfg *Config) fetcher.Fetcher {
+	return &bundleFetcher{
+		prefixes: map[string]string{
+			ensureTrailingSlash(cfg.MetadataURL): bundleMetadataDir,
+			ensureTrailingSlash(cfg.TargetsURL):  bundleTargetsDir,
+		},
+		dir: b.dir,
+	}
+}
+
+// bundleFetcher implements fetcher.Fetcher reading the files of an extracted bundle.
+// Missing files are reported as HTTP 404, so that go-tuf stops looking for newer roots.
+type bundleFetcher struct {
+	prefixes map[string]string
+	dir      string
+}
+
+func (f *bundleFetcher) DownloadFile(urlPath string, maxLength int64, _ time.Duration) ([]byte, error) {
+	name, ok := bundlePath(f.prefixes, urlPath)
+	if !ok {
+		return nil, &metadata.ErrDownloadHTTP{StatusCode: http.StatusNotFound, URL: urlPath}
+	}
+
+	file, err := os.Open(filepath.Join(f.dir, filepath.FromSlash(name)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, &metadata.ErrDownloadHTTP{StatusCode: http.StatusNotFound, URL: urlPath}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxLength+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxLength {
+		return nil, &metadata.ErrDownloadLengthMismatch{Msg: fmt.Sprintf("download failed for %s, length is larger than expected %d", urlPath, maxLength)}
+	}
+	return data, nil
+}
+
+// recordingFetcher downloads files from the remote repository and records them
+// with their location in a bundle.
+type recordingFetcher struct {
+	fetcher.Fetcher
+	prefixes map[string]string
+
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func (f *recordingFetcher) DownloadFile(urlPath string, maxLength int64, timeout time.Duration) ([]byte, error) {
+	data, err := f.Fetcher.DownloadFile(urlPath, maxLength, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if name, ok := bundlePath(f.prefixes, urlPath); ok {
+		f.mu.Lock()
+		f.files[name] = data
+		f.mu.Unlock()
+	}
+	return data, nil
+}
+
+// bundlePath maps a repository URL to its location in a bundle.
+func bundlePath(prefixes map[string]string, urlPath string) (string, bool) {
+	for prefix, dir := range prefixes {
+		if rest, ok := strings.CutPrefix(urlPath, prefix); ok && filepath.IsLocal(rest) {
+			return path.Join(dir, rest), true
+		}
+	}
+	return "", false
+}
+
+func ensureTrailingSlash(url string) string {
+	if strings.HasSuffix(url, "/") {
+		return url
+	}
+	return url + "/"
+}
+
+// ExportBundle builds an offline update bundle on a connected machine and writes it to w.
+// It bootstraps a fresh TUF client from the pinned root, so the bundle holds the whole
+// root chain, the top-level and delegated metadata, the index of every service and
+// their artifacts, verified against their index.
+func ExportBundle(ctx context.Context, cfg *Config, w io.Writer, log metadata.Logger) error {
+	services, err := cfg.LoadServices()
+	if err != nil {
+		return err
+	}
+	root, err := loadInitialRoot(cfg)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.MkdirTemp("", "nebula-bundle-")
+	if err != nil {
+		return fmt.Errorf("failed to create a temporary folder: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	metadataDir := filepath.Join(tmp, "metadata")
+	if err := os.Mkdir(metadataDir, 0750); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(metadataDir, "root.json"), root, 0644); err != nil {
+		return err
+	}
+
+	rec := &recordingFetcher{
+		Fetcher: &fetcher.DefaultFetcher{},
+		prefixes: map[string]string{
+			ensureTrailingSlash(cfg.MetadataURL): bundleMetadataDir,
+			ensureTrailingSlash(cfg.TargetsURL):  bundleTargetsDir,
+		},
+		files: map[string][]byte{},
+	}
+
+	// The artifacts are streamed from their staged file into the bundle, by their bundle path
+	artifacts := map[string]string{}
+	for _, svc := range services {
+		exported := *svc
+		exported.targetsDir = filepath.Join(tmp, "data")
+
+		content, _, err := DownloadTargetIndex(cfg, &exported, metadataDir, rec)
+		if err != nil {
+			return fmt.Errorf("failed to download the index of %s: %w", svc.Name, err)
+		}
+		index, err := parseIndex(svc.Name, content)
+		if err != nil {
+			return err
+		}
+
+		// Artifacts published as TUF targets are stored with the targets of the bundle
+		if svc.ArtifactTarget != "" {
+			target, err := GetArtifactTarget(cfg, &exported, metadataDir, rec, svc.artifactTargetPath(index.Version))
+			if err == nil {
+				artifact := filepath.Join(tmp, svc.Name+".zip")
+				log.Info("Downloading target artifact", "service", svc.Name, "version", index.Version, "target", target.Path)
+				hash, err := stageArtifact(ctx, artifact, target.Length, httpOpener(ensureTrailingSlash(cfg.TargetsURL)+target.RemotePath))
+				if err != nil {
+					return fmt.Errorf("failed to download the artifact of %s: %w", svc.Name, err)
+				}
+				if hash != target.SHA256 || hash != index.Hashes.Sha256 {
+					return fmt.Errorf("artifact of %s: %w", svc.Name, ErrHashMismatch)
+				}
+				artifacts[path.Join(bundleTargetsDir, target.RemotePath)] = artifact
+				continue
+			}
+			if !errors.Is(err, ErrTargetNotFound) {
+				return err
+			}
+			log.Info("Artifact is not a TUF target, falling back to its index path", "service", svc.Name)
+		}
+
+		size, err := artifactSize(index)
+		if err != nil {
+			return fmt.Errorf("artifact of %s: %w", svc.Name, err)
+		}
+		open, err := cfg.artifactOpener(index.Path)
+		if err != nil {
+			return fmt.Errorf("artifact of %s: %w", svc.Name, err)
+		}
+		artifact := filepath.Join(tmp, svc.Name+".zip")
+		log.Info("Downloading artifact", "service", svc.Name, "version", index.Version)
+		hash, err := stageArtifact(ctx, artifact, size, open)
+		if err != nil {
+			return fmt.Errorf("failed to download the artifact of %s: %w", svc.Name, err)
+		}
+		if hash != index.Hashes.Sha256 {
+			return fmt.Errorf("artifact of %s: %w", svc.Name, ErrHashMismatch)
+		}
+		artifacts[path.Join(bundleArtifactsDir, svc.Name+".zip")] = artifact
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	names := make([]string, 0, len(rec.files))
+	for name := range rec.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := writeTarFile(tw, name, rec.files[name]); err != nil {
+			return err
+		}
+	}
+	names = names[:0]
+	for name := range artifacts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := writeTarArtifact(tw, name, artifacts[name]); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	log.Info("✅ Bundle exported", "files", len(rec.files)+len(artifacts), "services", len(artifacts))
+	return nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	hdr := &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		Typeflag: tar.TypeReg,
+		ModTime:  time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	return nil
+}
+
+// writeTarArtifact copies the artifact staged at file to the bundle, without holding it in memory.
+func writeTarArtifact(tw *tar.Writer, name, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     info.Size(),
+		Typeflag: tar.TypeReg,
+		ModTime:  time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	if _, err := io.Copy(tw, f); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	return nil
+}
+
+// ImportBundle verifies an offline update bundle with the trusted TUF metadata and installs,
+// through the normal apply path, the services of the bundle that have a new release.
+func ImportBundle(ctx context.Context, cfg *Config, r io.Reader, log metadata.Logger, opts ...Option) ([]*ActivateResult, error) {
+	services, err := cfg.LoadServices()
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(cfg.InstallDir, fmt.Sprintf(".bundle-%d", time.Now().UnixNano()))
+	b, err := ExtractBundle(r, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close()
+
+	var (
+		results []*ActivateResult
+		errs    []error
+	)
+	for _, svc := range services {
+		if !b.hasService(svc) {
+			continue
+		}
+		u, err := New(cfg, svc, log, append([]Option{WithBundle(b)}, opts...)...)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		res, err := u.Apply(ctx)
+		if errors.Is(err, ErrNoUpdate) {
+			log.Info("The installed version is the one of the bundle", "service", svc.Name)
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		log.Info("✅ Bundle applied", "service", svc.Name, "version", res.Version)
+		results = append(results, res)
+	}
+	return results, errors.Join(errs...)
+}
+
+// ImportBundleFile imports the bundle stored at path.
+func ImportBundleFile(ctx context.Context, cfg *Config, path string, log metadata.Logger, opts ...Option) ([]*ActivateResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bundle: %w", err)
+	}
+	defer f.Close()
+	return ImportBundle(ctx, cfg, f, log, opts...)
+}
+
+// bundleLoop imports the bundles uploaded to the bundle folder as they arrive, and every interval.
+// Imported bundles are deleted and the ones that fail are renamed to *.failed.
+// Bundles uploaded outside the maintenance windows wait for the next window.
+func bundleLoop(ctx context.Context, cfg *Config, interval time.Duration, schedule *Schedule, log metadata.Logger) {
+	w := newWaiter(ctx, interval, log, cfg.BundleDir)
+	defer w.stop()
+	var queued bool
+	for w.wait(ctx) {
+		bundles, err := filepath.Glob(filepath.Join(cfg.BundleDir, "*.tar.gz"))
+		if err != nil {
+			log.Error(err, "Failed to list the uploaded bundles")
+			continue
+		}
+		if now := time.Now(); len(bundles) > 0 && !schedule.Open(now) {
+			if !queued {
+				next, _ := schedule.NextOpen(now)
+				log.Info("🕑 Bundles uploaded outside the maintenance windows, queued", "bundles", len(bundles), "scheduled-for", next.Format(time.RFC3339))
+				queued = true
+			}
+			continue
+		}
+		queued = false
+		for _, bundle := range bundles {
+			log.Info("📦 Importing bundle", "bundle", bundle)
+			if _, err := ImportBundleFile(ctx, cfg, bundle, log); err != nil {
+				log.Error(err, "❌ Failed to import bundle", "bundle", bundle)
+				if err := os.Rename(bundle, bundle+".failed"); err != nil {
+					log.Error(err, "Failed to set aside the bundle", "bundle", bundle)
+				}
+				continue
+			}
+			if err := os.Remove(bundle); err != nil {
+				log.Error(err, "Failed to remove the imported bundle", "bundle", bundle)
+			}
+		}
+	}
+}
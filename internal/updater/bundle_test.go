@@ -0,0 +1,55 @@
+package updater
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBundleTakesExtractedArtifact(t *testing.T) {
+	artifact := []byte("artifact of the bundle")
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	if err := writeTarFile(tw, "artifacts/app.zip", artifact); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tmp := t.TempDir()
+	b, err := ExtractBundle(&buf, filepath.Join(tmp, "bundle"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	name := b.artifactFile("app", nil)
+	if _, ok := b.take(name, filepath.Join(tmp, "wrong-size.zip"), int64(len(artifact))+1); ok {
+		t.Fatal("take() moved an artifact of another size")
+	}
+	dst := filepath.Join(tmp, "staging", "app.zip")
+	hash, ok := b.take(name, dst, int64(len(artifact)))
+	if !ok {
+		t.Fatal("take() = false, want the extracted artifact")
+	}
+	sum := sha256.Sum256(artifact)
+	if hash != hex.EncodeToString(sum[:]) {
+		t.Errorf("take() hash = %s, want %x", hash, sum)
+	}
+	if data, err := os.ReadFile(dst); err != nil || !bytes.Equal(data, artifact) {
+		t.Errorf("staged artifact = %q, %v", data, err)
+	}
+	if _, ok := b.take(name, dst, int64(len(artifact))); ok {
+		t.Error("take() moved the artifact twice")
+	}
+}
@@ -0,0 +1,252 @@
+package updater
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/peterbourgon/ff/v4"
+)
+
+// Default values used when a flag is neither set in the config file nor in the environment.
+const (
+	DefaultMetadataURL = "https://sorayaormazabalmayo.github.io/TUF_Repository_YubiKey_Vault/metadata"
+	DefaultTargetsURL  = "https://sorayaormazabalmayo.github.io/TUF_Repository_YubiKey_Vault/targets"
+	DefaultService     = "nebula-on-premise-linux"
+	DefaultChannel     = "stable"
+	DefaultInstallDir  = "/opt/nebula-on-premise-linux"
+	DefaultStatusFile  = "/opt/nebula-on-premise-linux/update_status.json"
+	DefaultBundleDir   = "/opt/nebula-on-premise-linux/bundles"
+	DefaultInventory   = "/opt/nebula-on-premise-linux/versions.json"
+	DefaultRollback    = "/opt/nebula-on-premise-linux/rollback_request.json"
+)
+
+// Config holds the updater configuration parameters. Every path the updater
+// touches is either configured here or derived from InstallDir.
+type Config struct {
+	MetadataURL           string
+	TargetsURL            string
+	Service               string
+	UnitName              string
+	Channel               string
+	InstallDir            string
+	StatusFile            string
+	LogFile               string
+	ServiceAccountKeyPath string
+	ServiceLink           string
+	ConfigLink            string
+	ServicesFile          string
+	RootFile              string
+	RootSHA256            string
+	RootKeyIDs            []string
+	BundleDir             string
+	MirrorAddr            string
+	MachineIDFile         string
+	InventoryFile         string
+	RollbackFile          string
+	ControlSocket         string
+	KeepVersions          int
+	KeepDays              int
+	PinnedVersions        []string
+	MaintenanceWindows    []string
+	Timezone              string
+	AutoUpdate            bool
+	AutoUpdatePolicy      string
+	HealthURL             string
+	ArtifactTarget        string
+	S3Endpoint            string
+	S3Region              string
+	S3AccessKey           string
+	S3SecretKey           string
+	OCIUsername           string
+	OCIPassword           string
+	HealthTimeout         time.Duration
+	HealthStablePeriod    time.Duration
+	CheckInterval         time.Duration
+	CheckJitter           time.Duration
+	PollInterval          time.Duration
+	Verbosity             int
+}
+
+// RegisterFlags declares the updater flags in the given flag set, so that
+// they can be set from the command line, the YAML config file or the environment.
+func (c *Config) RegisterFlags(fs *ff.FlagSet) {
+	fs.StringVar(&c.MetadataURL, 0, "metadata-url", DefaultMetadataURL, "TUF metadata URL")
+	fs.StringVar(&c.TargetsURL, 0, "targets-url", DefaultTargetsURL, "TUF targets URL")
+	fs.StringVar(&c.Service, 0, "service", DefaultService, "name of the service to update")
+	fs.StringVar(&c.UnitName, 0, "unit", "", "systemd unit of the service (default <service>.service)")
+	fs.StringVar(&c.Channel, 0, "channel", DefaultChannel, "release channel followed by the services, e.g. stable, beta or canary")
+	fs.StringVar(&c.InstallDir, 0, "install-dir", DefaultInstallDir, "directory holding the installed versions and the TUF data")
+	fs.StringVar(&c.StatusFile, 0, "status-file", DefaultStatusFile, "update status file shared with the server")
+	fs.StringVar(&c.LogFile, 0, "log-file", "", "updater log file (default <install-dir>/nebula_tuf_client.log)")
+	fs.StringVar(&c.ServiceAccountKeyPath, 0, "service-account-key", "", "Google service account key used to download artifacts")
+	fs.StringVar(&c.ServiceLink, 0, "service-link", "/usr/local/bin/nebula-on-premise-linux", "symlink pointing to the running service binary")
+	fs.StringVar(&c.ConfigLink, 0, "config-link", "/etc/nebula-on-premise-linux/nebula-on-premise-linux.yml", "symlink pointing to the running service config")
+	fs.StringVar(&c.ServicesFile, 0, "services-file", "", "YAML file declaring the services to update (default only --service)")
+	fs.StringVar(&c.RootFile, 0, "root-file", "", "initial root metadata, used when none is embedded in the binary")
+	fs.StringVar(&c.RootSHA256, 0, "root-sha256", "", "expected SHA256 of the initial root metadata")
+	fs.StringListVar(&c.RootKeyIDs, 0, "root-key-id", "key ID allowed to sign the initial root metadata (repeatable)")
+	fs.StringVar(&c.BundleDir, 0, "bundle-dir", DefaultBundleDir, "directory watched for uploaded offline update bundles")
+	fs.StringVar(&c.MirrorAddr, 0, "mirror-addr", "", "address where the verified metadata and targets are served to other nodes (default disabled)")
+	fs.StringVar(&c.ArtifactTarget, 0, "artifact-target", "", "TUF target path of the artifact, {version} is replaced by the index version (default the index path)")
+	fs.StringVar(&c.S3Endpoint, 0, "s3-endpoint", "https://s3.amazonaws.com", "endpoint of the S3-compatible store serving s3:// artifacts")
+	fs.StringVar(&c.S3Region, 0, "s3-region", "us-east-1", "region used to sign the S3 requests")
+	fs.StringVar(&c.S3AccessKey, 0, "s3-access-key", "", "S3 access key (default anonymous requests)")
+	fs.StringVar(&c.S3SecretKey, 0, "s3-secret-key", "", "S3 secret key")
+	fs.StringVar(&c.OCIUsername, 0, "oci-username", "", "username of the OCI registry serving oci:// artifacts (default anonymous)")
+	fs.StringVar(&c.OCIPassword, 0, "oci-password", "", "password or token of the OCI registry")
+	fs.StringVar(&c.MachineIDFile, 0, "machine-id-file", "/etc/machine-id", "file holding the machine identity used for staged rollouts")
+	fs.StringVar(&c.InventoryFile, 0, "inventory-file", DefaultInventory, "file listing the installed versions, shared with the server")
+	fs.StringVar(&c.RollbackFile, 0, "rollback-file", DefaultRollback, "file where the server requests rollbacks")
+	fs.StringVar(&c.ControlSocket, 0, "control-socket", DefaultControlSocket, "Unix socket where the control API used by the server is served (empty to only use the status file)")
+	fs.IntVar(&c.KeepVersions, 0, "keep-versions", 2, "number of most recent versions kept installed")
+	fs.IntVar(&c.KeepDays, 0, "keep-days", 0, "keep the versions released less than this many days ago (default disabled)")
+	fs.StringListVar(&c.PinnedVersions, 0, "pin-version", "version that is never deleted (repeatable)")
+	fs.StringListVar(&c.MaintenanceWindows, 0, "maintenance-window", "window when updates may restart the services, e.g. \"Mon-Fri 02:00-04:00\" or \"30 2 * * 1-5 90m\" (repeatable, default always)")
+	fs.StringVar(&c.Timezone, 0, "timezone", "Local", "site timezone of the maintenance windows, e.g. Europe/Madrid")
+	fs.BoolVarDefault(&c.AutoUpdate, 0, "auto-update", false, "install the verified releases without waiting for the user to request them")
+	fs.StringVar(&c.AutoUpdatePolicy, 0, "auto-update-policy", AutoUpdateAll, "releases installed automatically: all (right away), critical (only the releases marked critical, right away) or window (all, inside the maintenance windows)")
+	fs.StringVar(&c.HealthURL, 0, "health-url", "", "HTTP endpoint probed after a restart to confirm the new version is healthy")
+	fs.DurationVar(&c.HealthTimeout, 0, "health-timeout", 60*time.Second, "time the new version has to become active and healthy")
+	fs.DurationVar(&c.HealthStablePeriod, 0, "health-stable-period", 30*time.Second, "time the new version must keep running without restarts")
+	fs.DurationVar(&c.CheckInterval, 0, "check-interval", 60*time.Second, "interval between update checks")
+	fs.DurationVar(&c.CheckJitter, 0, "check-jitter", 30*time.Second, "random delay added to every check interval, so that the fleet does not check at once")
+	fs.DurationVar(&c.PollInterval, 0, "poll-interval", 30*time.Second, "interval between polls of the request files, in case their file events are missed")
+	fs.IntVar(&c.Verbosity, 0, "verbosity", 0, "TUF client log verbosity")
+}
+
+// Validate checks if required values are present and well formed.
+func (c *Config) Validate() error {
+	var errs []error
+
+	for _, u := range []struct {
+		name, value string
+		optional    bool
+	}{
+		{"metadata-url", c.MetadataURL, false},
+		{"targets-url", c.TargetsURL, false},
+		{"health-url", c.HealthURL, true},
+		{"s3-endpoint", c.S3Endpoint, false},
+	} {
+		if u.value == "" && u.optional {
+			continue
+		}
+		if err := validateURL(u.value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s %q: %w", u.name, u.value, err))
+		}
+	}
+	if c.Service == "" {
+		errs = append(errs, errors.New("service must not be empty"))
+	} else if c.Service != filepath.Base(c.Service) {
+		errs = append(errs, fmt.Errorf("invalid service %q: must be a plain name", c.Service))
+	}
+	for _, p := range []struct {
+		name, value string
+		optional    bool
+	}{
+		{"install-dir", c.InstallDir, false},
+		{"status-file", c.StatusFile, false},
+		{"log-file", c.LogFile, true},
+		{"service-account-key", c.ServiceAccountKeyPath, true},
+		{"service-link", c.ServiceLink, false},
+		{"config-link", c.ConfigLink, false},
+		{"services-file", c.ServicesFile, true},
+		{"root-file", c.RootFile, true},
+		{"bundle-dir", c.BundleDir, false},
+		{"machine-id-file", c.MachineIDFile, false},
+		{"inventory-file", c.InventoryFile, false},
+		{"rollback-file", c.RollbackFile, false},
+		{"control-socket", c.ControlSocket, true},
+	} {
+		if p.value == "" && p.optional {
+			continue
+		}
+		if !filepath.IsAbs(p.value) {
+			errs = append(errs, fmt.Errorf("invalid %s %q: must be an absolute path", p.name, p.value))
+		}
+	}
+	if c.RootSHA256 != "" {
+		if b, err := hex.DecodeString(c.RootSHA256); err != nil || len(b) != sha256.Size {
+			errs = append(errs, fmt.Errorf("invalid root-sha256 %q: must be a hex encoded SHA256", c.RootSHA256))
+		}
+	}
+	if c.CheckInterval <= 0 {
+		errs = append(errs, fmt.Errorf("invalid check-interval %s: must be positive", c.CheckInterval))
+	}
+	if c.CheckJitter < 0 {
+		errs = append(errs, fmt.Errorf("invalid check-jitter %s: must not be negative", c.CheckJitter))
+	}
+	if c.PollInterval <= 0 {
+		errs = append(errs, fmt.Errorf("invalid poll-interval %s: must be positive", c.PollInterval))
+	}
+	if c.KeepVersions < 1 {
+		errs = append(errs, fmt.Errorf("invalid keep-versions %d: must be at least 1", c.KeepVersions))
+	}
+	if c.KeepDays < 0 {
+		errs = append(errs, fmt.Errorf("invalid keep-days %d: must not be negative", c.KeepDays))
+	}
+	if _, err := c.Schedule(); err != nil {
+		errs = append(errs, err)
+	}
+	switch c.AutoUpdatePolicy {
+	case AutoUpdateAll, AutoUpdateCritical:
+	case AutoUpdateWindow:
+		if c.AutoUpdate && len(c.MaintenanceWindows) == 0 {
+			errs = append(errs, fmt.Errorf("invalid auto-update-policy %q: requires at least one maintenance-window", c.AutoUpdatePolicy))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("invalid auto-update-policy %q: must be %s, %s or %s", c.AutoUpdatePolicy, AutoUpdateAll, AutoUpdateCritical, AutoUpdateWindow))
+	}
+	if c.HealthTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("invalid health-timeout %s: must be positive", c.HealthTimeout))
+	}
+	if c.HealthStablePeriod < 0 {
+		errs = append(errs, fmt.Errorf("invalid health-stable-period %s: must not be negative", c.HealthStablePeriod))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// LogFilePath returns the updater log file.
+func (c *Config) LogFilePath() string {
+	if c.LogFile != "" {
+		return c.LogFile
+	}
+	return filepath.Join(c.InstallDir, "nebula_tuf_client.log")
+}
+
+// MetadataDir returns the directory where the trusted TUF metadata is stored.
+func (c *Config) MetadataDir() string {
+	return filepath.Join(c.InstallDir, "tmp")
+}
+
+// StagingDir returns the directory where artifacts are downloaded until they are verified.
+func (c *Config) StagingDir() string {
+	return filepath.Join(c.InstallDir, "staging")
+}
+
+// TargetsDir returns the directory where the downloaded TUF targets are stored.
+func (c *Config) TargetsDir() string {
+	return filepath.Join(c.InstallDir, "data")
+}
+
+func validateURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("scheme must be http or https")
+	}
+	if u.Host == "" {
+		return errors.New("host is missing")
+	}
+	return nil
+}
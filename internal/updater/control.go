@@ -0,0 +1,507 @@
+package updater
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// DefaultControlSocket is the Unix socket where the updater serves its control API.
+const DefaultControlSocket = "/run/nebula-tuf-client/control.sock"
+
+// progressInterval is the minimum interval between the notifications of the download progress.
+const progressInterval = 250 * time.Millisecond
+
+// Control API routes, served over HTTP on the control socket. Every request names its
+// service, which may be omitted when a single service is configured.
+const (
+	controlStatusPath   = "/v1/status"
+	controlCheckPath    = "/v1/check"
+	controlApplyPath    = "/v1/apply"
+	controlCancelPath   = "/v1/cancel"
+	controlRollbackPath = "/v1/rollback"
+)
+
+var (
+	// ErrCanceled is returned by Apply when the update is cancelled before its install.
+	ErrCanceled = errors.New("update canceled")
+	// ErrCancelTooLate is returned when cancelling an update whose release is already being installed.
+	ErrCancelTooLate = errors.New("the release is already being installed, the update cannot be cancelled")
+	// ErrNothingToCancel is returned when cancelling while no update is requested.
+	ErrNothingToCancel = errors.New("no update is requested")
+)
+
+// ControlRequest is the body of the check, apply, cancel and rollback requests of the
+// control API. Version is the version to roll back to, the previous retained one when empty.
+type ControlRequest struct {
+	Service string `json:"service,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+// ServiceStatus is the update status of a service reported by the control API. The release
+// fields describe the available release, and Progress the download of the running update.
+type ServiceStatus struct {
+	Service             string     `json:"service"`
+	Channel             string     `json:"channel"`
+	CurrentVersion      string     `json:"current_version"`
+	AvailableVersion    string     `json:"available_version,omitempty"`
+	ReleaseDate         string     `json:"release_date,omitempty"`
+	ArtifactSize        int64      `json:"artifact_size,omitempty"`
+	UpdateAvailable     bool       `json:"update_available"`
+	UpdateRequested     bool       `json:"update_requested"`
+	AutomaticUpdate     bool       `json:"automatic_update"`
+	AutoUpdate          bool       `json:"auto_update"`
+	AutoUpdatePolicy    string     `json:"auto_update_policy,omitempty"`
+	ScheduledFor        string     `json:"scheduled_for,omitempty"`
+	Applying            bool       `json:"applying"`
+	Phase               Phase      `json:"phase,omitempty"`
+	Progress            *Progress  `json:"progress,omitempty"`
+	LastCheck           *time.Time `json:"last_check,omitempty"`
+	LastSuccessfulCheck *time.Time `json:"last_successful_check,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastErrorAt         *time.Time `json:"last_error_at,omitempty"`
+}
+
+// Progress is the progress of a phase, in bytes for the download.
+type Progress struct {
+	Done    int64   `json:"done"`
+	Total   int64   `json:"total"`
+	Percent float64 `json:"percent"`
+}
+
+// controlError is the body of the control API error responses.
+type controlError struct {
+	Error string `json:"error"`
+}
+
+// startApply records that Apply runs and how to cancel it.
+func (u *Updater) startApply(cancel context.CancelFunc) {
+	defer publishStatus()
+	u.ctlMu.Lock()
+	defer u.ctlMu.Unlock()
+	u.applying, u.phase, u.cancel, u.canceled = true, PhaseCheck, cancel, false
+	u.release, u.progress = "", nil
+}
+
+// endApply records that Apply returned.
+func (u *Updater) endApply() {
+	defer publishStatus()
+	u.ctlMu.Lock()
+	defer u.ctlMu.Unlock()
+	u.applying, u.phase, u.cancel = false, "", nil
+}
+
+// setRelease records the release Apply installs.
+func (u *Updater) setRelease(version string) {
+	u.ctlMu.Lock()
+	defer u.ctlMu.Unlock()
+	u.release = version
+}
+
+// appliedRelease returns the release of the running or last Apply, empty when it
+// stopped before the check.
+func (u *Updater) appliedRelease() string {
+	u.ctlMu.Lock()
+	defer u.ctlMu.Unlock()
+	return u.release
+}
+
+// setPhase records the phase Apply is running.
+func (u *Updater) setPhase(phase Phase) {
+	defer publishStatus()
+	u.ctlMu.Lock()
+	defer u.ctlMu.Unlock()
+	u.phase = phase
+}
+
+// commitApply moves Apply to the install phase, after which it can no longer be cancelled.
+// It returns false when the update was cancelled.
+func (u *Updater) commitApply() bool {
+	defer publishStatus()
+	u.ctlMu.Lock()
+	defer u.ctlMu.Unlock()
+	if u.canceled {
+		return false
+	}
+	u.phase, u.cancel = PhaseInstall, nil
+	return true
+}
+
+// recordCheck keeps the outcome of the last check for the status.
+func (u *Updater) recordCheck(res *CheckResult, err error) {
+	defer publishStatus()
+	u.ctlMu.Lock()
+	defer u.ctlMu.Unlock()
+	u.lastCheck = time.Now()
+	if err != nil {
+		u.lastErr, u.lastErrAt = err, u.lastCheck
+		return
+	}
+	u.lastResult, u.lastSuccess = res, u.lastCheck
+}
+
+// recordError keeps the last error of an update for the status.
+func (u *Updater) recordError(err error) {
+	defer publishStatus()
+	u.ctlMu.Lock()
+	defer u.ctlMu.Unlock()
+	u.lastErr, u.lastErrAt = err, time.Now()
+}
+
+// setProgress records the bytes of the artifact downloaded so far. The subscribers are
+// notified at most every progressInterval.
+func (u *Updater) setProgress(done, total int64) {
+	u.ctlMu.Lock()
+	u.progress = &Progress{Done: done, Total: total}
+	if total > 0 {
+		u.progress.Percent = math.Round(float64(done)*1000/float64(total)) / 10
+	}
+	publish := done == total || time.Since(u.progressAt) >= progressInterval
+	if publish {
+		u.progressAt = time.Now()
+	}
+	u.ctlMu.Unlock()
+
+	if publish {
+		publishStatus()
+	}
+}
+
+// Status returns the update status of the service.
+func (u *Updater) Status() (*ServiceStatus, error) {
+	status, err := readUpdateStatus(u.svc.StatusFile)
+	if err != nil {
+		return nil, err
+	}
+	current, err := installedVersion(u.svc)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &ServiceStatus{
+		Service:         u.svc.Name,
+		Channel:         u.svc.Channel,
+		CurrentVersion:  current,
+		UpdateAvailable: status.UpdateAvailable == 1,
+		UpdateRequested: status.UpdateRequested == 1,
+		AutomaticUpdate: status.AutomaticUpdate == 1,
+		ScheduledFor:    status.ScheduledFor,
+		AutoUpdate:      u.cfg.AutoUpdate,
+	}
+	if u.cfg.AutoUpdate {
+		res.AutoUpdatePolicy = u.cfg.AutoUpdatePolicy
+	}
+
+	u.ctlMu.Lock()
+	defer u.ctlMu.Unlock()
+	res.Applying, res.Phase = u.applying, u.phase
+	if u.applying && u.phase == PhaseDownload && u.progress != nil {
+		progress := *u.progress
+		res.Progress = &progress
+	}
+	res.LastCheck = timePtr(u.lastCheck)
+	res.LastSuccessfulCheck = timePtr(u.lastSuccess)
+	if u.lastResult != nil && u.lastResult.UpdateAvailable {
+		index := u.lastResult.Index
+		res.AvailableVersion, res.ReleaseDate = index.Version, index.ReleaseDate
+		res.ArtifactSize, _ = artifactSize(&index)
+	}
+	if u.lastErr != nil {
+		res.LastError = u.lastErr.Error()
+		res.LastErrorAt = timePtr(u.lastErrAt)
+	}
+	return res, nil
+}
+
+// timePtr returns a pointer to t, or nil when t is zero so that it is omitted.
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// Request asks for the update of the service, as the user does from the UI. It is applied
+// by the apply loop, right away or in the next maintenance window.
+func (u *Updater) Request() error {
+	status, err := readUpdateStatus(u.svc.StatusFile)
+	if err != nil {
+		return err
+	}
+	if status.UpdateAvailable != 1 {
+		return ErrNoUpdate
+	}
+	return updateStatusFile(u.svc.StatusFile, func(s *UpdateStatus) {
+		s.UpdateRequested, s.AutomaticUpdate = 1, 0
+	})
+}
+
+// Cancel cancels the requested update of the service. An update being applied can be
+// cancelled until its release starts to be installed. A cancelled automatic update is
+// not requested again for the same release.
+func (u *Updater) Cancel() error {
+	u.ctlMu.Lock()
+	if u.applying {
+		defer u.ctlMu.Unlock()
+		if u.cancel == nil {
+			return ErrCancelTooLate
+		}
+		u.cancel()
+		u.canceled = true
+		return nil
+	}
+	u.ctlMu.Unlock()
+
+	status, err := readUpdateStatus(u.svc.StatusFile)
+	if err != nil {
+		return err
+	}
+	if status.UpdateRequested != 1 {
+		return ErrNothingToCancel
+	}
+	if status.AutomaticUpdate == 1 {
+		u.ctlMu.Lock()
+		var version string
+		if u.lastResult != nil {
+			version = u.lastResult.Index.Version
+		}
+		u.ctlMu.Unlock()
+		u.autoUpdateFailed(version)
+	}
+	return updateStatusFile(u.svc.StatusFile, func(s *UpdateStatus) {
+		s.UpdateRequested, s.AutomaticUpdate, s.ScheduledFor = 0, 0, ""
+	})
+}
+
+// ControlHandler serves the control API of the updaters. The rollbacks outlast their
+// request, as the service restarts, and run until ctx is done.
+func ControlHandler(ctx context.Context, updaters []*Updater) http.Handler {
+	find := func(name string) (*Updater, error) {
+		services := make([]*ServiceConfig, 0, len(updaters))
+		for _, u := range updaters {
+			services = append(services, u.svc)
+		}
+		svc, err := findService(services, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range updaters {
+			if u.svc == svc {
+				return u, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown service %q", name)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+controlStatusPath, func(w http.ResponseWriter, r *http.Request) {
+		u, err := find(r.URL.Query().Get("service"))
+		if err != nil {
+			writeControlError(w, http.StatusNotFound, err)
+			return
+		}
+		writeControlStatus(w, http.StatusOK, u)
+	})
+	mux.HandleFunc("POST "+controlCheckPath, controlAction(find, http.StatusOK, func(r *http.Request, _ *ControlRequest, u *Updater) error {
+		_, err := u.checkOnce(r.Context())
+		return err
+	}))
+	mux.HandleFunc("POST "+controlApplyPath, controlAction(find, http.StatusAccepted, func(_ *http.Request, _ *ControlRequest, u *Updater) error {
+		return u.Request()
+	}))
+	mux.HandleFunc("POST "+controlCancelPath, controlAction(find, http.StatusOK, func(_ *http.Request, _ *ControlRequest, u *Updater) error {
+		return u.Cancel()
+	}))
+	mux.HandleFunc("POST "+controlRollbackPath, controlAction(find, http.StatusAccepted, func(_ *http.Request, req *ControlRequest, u *Updater) error {
+		return u.startRollback(ctx, req.Version)
+	}))
+	return mux
+}
+
+// controlAction returns a handler decoding a ControlRequest, running action on the updater
+// of its service and responding with the status of the service.
+func controlAction(find func(string) (*Updater, error), code int, action func(*http.Request, *ControlRequest, *Updater) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ControlRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			writeControlError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+			return
+		}
+		u, err := find(req.Service)
+		if err != nil {
+			writeControlError(w, http.StatusNotFound, err)
+			return
+		}
+		if err := action(r, &req, u); err != nil {
+			switch {
+			case errors.Is(err, ErrNoUpdate), errors.Is(err, ErrCancelTooLate), errors.Is(err, ErrNothingToCancel),
+				errors.Is(err, ErrNoRollbackTarget):
+				writeControlError(w, http.StatusConflict, err)
+			default:
+				writeControlError(w, http.StatusInternalServerError, err)
+			}
+			return
+		}
+		writeControlStatus(w, code, u)
+	}
+}
+
+func writeControlStatus(w http.ResponseWriter, code int, u *Updater) {
+	status, err := u.Status()
+	if err != nil {
+		writeControlError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
+
+func writeControlError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(controlError{Error: err.Error()})
+}
+
+// runControl serves the control API on the control socket until ctx is done. The socket is
+// only accessible to the owner and the group of the updater.
+func runControl(ctx context.Context, cfg *Config, updaters []*Updater, log metadata.Logger) error {
+	if err := os.MkdirAll(filepath.Dir(cfg.ControlSocket), 0750); err != nil {
+		return fmt.Errorf("failed to create the control socket folder: %w", err)
+	}
+	// A socket left behind by a previous run prevents listening
+	os.Remove(cfg.ControlSocket)
+	ln, err := net.Listen("unix", cfg.ControlSocket)
+	if err != nil {
+		return fmt.Errorf("failed to listen on the control socket: %w", err)
+	}
+	if err := os.Chmod(cfg.ControlSocket, 0660); err != nil {
+		ln.Close()
+		return err
+	}
+
+	srv := &http.Server{
+		Handler:           ControlHandler(ctx, updaters),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Info("🎛️ Serving the control API", "socket", cfg.ControlSocket)
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("control server: %w", err)
+	}
+	return nil
+}
+
+// ControlClient calls the control API of the updater over its socket.
+type ControlClient struct {
+	client *http.Client
+}
+
+// NewControlClient returns a client of the control API served on socket.
+func NewControlClient(socket string) *ControlClient {
+	return &ControlClient{client: &http.Client{
+		Timeout: 60 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}}
+}
+
+// Status returns the update status of service.
+func (c *ControlClient) Status(ctx context.Context, service string) (*ServiceStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://updater"+controlStatusPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	if service != "" {
+		req.URL.RawQuery = url.Values{"service": {service}}.Encode()
+	}
+	return c.do(req)
+}
+
+// Check checks for an update of service.
+func (c *ControlClient) Check(ctx context.Context, service string) (*ServiceStatus, error) {
+	return c.post(ctx, controlCheckPath, ControlRequest{Service: service})
+}
+
+// Apply requests the update of service.
+func (c *ControlClient) Apply(ctx context.Context, service string) (*ServiceStatus, error) {
+	return c.post(ctx, controlApplyPath, ControlRequest{Service: service})
+}
+
+// Cancel cancels the requested update of service.
+func (c *ControlClient) Cancel(ctx context.Context, service string) (*ServiceStatus, error) {
+	return c.post(ctx, controlCancelPath, ControlRequest{Service: service})
+}
+
+// Rollback requests the rollback of service to version, the previous retained version
+// when empty. The rollback runs in the background, its failure is reported by the status.
+func (c *ControlClient) Rollback(ctx context.Context, service, version string) (*ServiceStatus, error) {
+	return c.post(ctx, controlRollbackPath, ControlRequest{Service: service, Version: version})
+}
+
+func (c *ControlClient) post(ctx context.Context, path string, creq ControlRequest) (*ServiceStatus, error) {
+	body, err := json.Marshal(creq)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://updater"+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.do(req)
+}
+
+func (c *ControlClient) do(req *http.Request) (*ServiceStatus, error) {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach the updater: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		var e controlError
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			return nil, fmt.Errorf("updater responded with status code %d", resp.StatusCode)
+		}
+		return nil, &ControlError{StatusCode: resp.StatusCode, Message: e.Error}
+	}
+	var status ServiceStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("failed to parse the updater response: %w", err)
+	}
+	return &status, nil
+}
+
+// ControlError is an error reported by the control API, e.g. a 409 when there is
+// no update to apply or cancel.
+type ControlError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *ControlError) Error() string {
+	return e.Message
+}
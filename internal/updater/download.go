@@ -0,0 +1,172 @@
+package updater
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// ErrTooLarge is returned when an artifact is larger than the length declared in its index.
+var ErrTooLarge = errors.New("artifact is larger than its declared length")
+
+// openFunc opens an artifact for reading from offset. It returns the offset the reader
+// actually starts at, which is 0 when the source cannot resume a partial download.
+type openFunc func(ctx context.Context, offset int64) (io.ReadCloser, int64, error)
+
+// stageArtifact downloads an artifact of the given size into the partial file, resuming
+// where a previous attempt stopped, and returns its SHA256 computed while streaming.
+// The download is aborted and the partial file deleted as soon as the artifact exceeds
+// its size. An interrupted download keeps the partial file so that it can be resumed.
+func stageArtifact(ctx context.Context, partial string, size int64, open openFunc) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(partial), 0750); err != nil {
+		return "", fmt.Errorf("failed to create the staging folder: %w", err)
+	}
+	f, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return "", fmt.Errorf("failed to open the partial download: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	offset := info.Size()
+	if offset > size {
+		offset = 0
+	}
+
+	// Hash what was already downloaded
+	hasher := sha256.New()
+	if offset > 0 {
+		if _, err := io.CopyN(hasher, f, offset); err != nil {
+			return "", fmt.Errorf("failed to hash the partial download: %w", err)
+		}
+	}
+
+	if offset < size {
+		rc, start, err := open(ctx, offset)
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+
+		if start != offset {
+			// The source restarted from the beginning
+			hasher.Reset()
+			offset = 0
+		}
+		if err := f.Truncate(offset); err != nil {
+			return "", err
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return "", err
+		}
+
+		n, err := io.Copy(io.MultiWriter(f, hasher), io.LimitReader(rc, size-offset+1))
+		offset += n
+		if offset > size {
+			f.Close()
+			os.Remove(partial)
+			return "", fmt.Errorf("%w of %d bytes", ErrTooLarge, size)
+		}
+		if err != nil {
+			return "", fmt.Errorf("download interrupted at %d of %d bytes: %w", offset, size, err)
+		}
+		if offset < size {
+			return "", fmt.Errorf("download incomplete: %d of %d bytes", offset, size)
+		}
+	}
+
+	if err := f.Sync(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// doRangeRequest sends req asking for the content from offset on. Servers that ignore
+// the Range header send the whole content, which is reported with a 0 offset.
+func doRangeRequest(req *http.Request, offset int64) (io.ReadCloser, int64, error) {
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to execute request: %w", err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		return resp.Body, offset, nil
+	case resp.StatusCode == http.StatusOK:
+		return resp.Body, 0, nil
+	default:
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("failed to download artifact, status code: %d", resp.StatusCode)
+	}
+}
+
+// progressOpener wraps open to report the bytes downloaded, including the ones of the partial
+// download being resumed.
+func progressOpener(open openFunc, report func(done int64)) openFunc {
+	return func(ctx context.Context, offset int64) (io.ReadCloser, int64, error) {
+		rc, start, err := open(ctx, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		report(start)
+		return &progressReader{ReadCloser: rc, done: start, report: report}, start, nil
+	}
+}
+
+type progressReader struct {
+	io.ReadCloser
+	done   int64
+	report func(done int64)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.done += int64(n)
+		r.report(r.done)
+	}
+	return n, err
+}
+
+// fileOpener opens a local artifact.
+func fileOpener(path string) openFunc {
+	return func(_ context.Context, offset int64) (io.ReadCloser, int64, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		return f, offset, nil
+	}
+}
+
+// artifactSize returns the length of the artifact declared in the index.
+func artifactSize(index *IndexInfo) (int64, error) {
+	size, err := strconv.ParseInt(index.Bytes, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid artifact length %q in the index", index.Bytes)
+	}
+	return size, nil
+}
+
+// validSHA256 reports whether s is a hex encoded SHA256.
+func validSHA256(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size
+}
@@ -0,0 +1,131 @@
+package updater
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+)
+
+// ErrUnhealthy is returned when a new version does not become healthy after the restart.
+var ErrUnhealthy = errors.New("service is not healthy after the restart")
+
+// healthPollInterval is the interval between the probes of the unit and the health endpoint.
+const healthPollInterval = time.Second
+
+// waitHealthy waits for the unit of the service to become active and for its health endpoint,
+// when configured, to answer with a 2xx status within timeout. Then it watches the unit for the
+// stable period to catch crash-loops: the unit must stay active and not be restarted by systemd.
+func waitHealthy(ctx context.Context, svc *ServiceConfig, timeout, stable time.Duration) error {
+	conn, err := dbus.NewSystemConnectionContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to system bus: %w", err)
+	}
+	defer conn.Close()
+
+	checkCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(healthPollInterval)
+	defer ticker.Stop()
+
+	for {
+		state, err := unitActiveState(checkCtx, conn, svc.Unit)
+		if err != nil {
+			return err
+		}
+		if state == "active" {
+			break
+		}
+		if state == "failed" {
+			return fmt.Errorf("%w: unit %s failed", ErrUnhealthy, svc.Unit)
+		}
+		select {
+		case <-ticker.C:
+		case <-checkCtx.Done():
+			return fmt.Errorf("%w: unit %s is %s after %s", ErrUnhealthy, svc.Unit, state, timeout)
+		}
+	}
+
+	if svc.HealthURL != "" {
+		if err := probeHealth(checkCtx, svc.HealthURL, ticker.C); err != nil {
+			return fmt.Errorf("%w: %w", ErrUnhealthy, err)
+		}
+	}
+
+	restarts, err := unitRestarts(ctx, conn, svc.Unit)
+	if err != nil {
+		return err
+	}
+	stableCtx, cancelStable := context.WithTimeout(ctx, stable)
+	defer cancelStable()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stableCtx.Done():
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return nil
+		}
+
+		state, err := unitActiveState(stableCtx, conn, svc.Unit)
+		if err != nil {
+			continue
+		}
+		if state != "active" {
+			return fmt.Errorf("%w: unit %s is %s", ErrUnhealthy, svc.Unit, state)
+		}
+		if n, err := unitRestarts(stableCtx, conn, svc.Unit); err == nil && n != restarts {
+			return fmt.Errorf("%w: unit %s is crash-looping", ErrUnhealthy, svc.Unit)
+		}
+	}
+}
+
+// probeHealth polls the health endpoint until it answers with a 2xx status or ctx is done.
+func probeHealth(ctx context.Context, url string, tick <-chan time.Time) error {
+	client := &http.Client{Timeout: 5 * time.Second}
+	var lastErr error
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				return nil
+			}
+			err = fmt.Errorf("health endpoint returned status code %d", resp.StatusCode)
+		}
+		lastErr = err
+
+		select {
+		case <-tick:
+		case <-ctx.Done():
+			return fmt.Errorf("health check %s did not succeed: %w", url, lastErr)
+		}
+	}
+}
+
+func unitActiveState(ctx context.Context, conn *dbus.Conn, unit string) (string, error) {
+	prop, err := conn.GetUnitPropertyContext(ctx, unit, "ActiveState")
+	if err != nil {
+		return "", fmt.Errorf("failed to get the state of unit %s: %w", unit, err)
+	}
+	state, _ := prop.Value.Value().(string)
+	return state, nil
+}
+
+func unitRestarts(ctx context.Context, conn *dbus.Conn, unit string) (uint32, error) {
+	prop, err := conn.GetUnitTypePropertyContext(ctx, unit, "Service", "NRestarts")
+	if err != nil {
+		return 0, fmt.Errorf("failed to get the restarts of unit %s: %w", unit, err)
+	}
+	n, _ := prop.Value.Value().(uint32)
+	return n, nil
+}
@@ -0,0 +1,72 @@
+package updater
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Results recorded in the update history.
+const (
+	ResultInstalled  = "installed"
+	ResultRolledBack = "rolled-back"
+	ResultFailed     = "failed"
+)
+
+// HistoryEntry records the outcome of an update of a service.
+type HistoryEntry struct {
+	Time            time.Time `json:"time"`
+	Service         string    `json:"service"`
+	Version         string    `json:"version"`
+	PreviousVersion string    `json:"previous_version,omitempty"`
+	Result          string    `json:"result"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// appendHistory appends an entry to the history file of the service.
+func appendHistory(svc *ServiceConfig, entry HistoryEntry) error {
+	entry.Service = svc.Name
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(svc.HistoryFile(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open history file: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write history file: %w", err)
+	}
+	return f.Close()
+}
+
+// ReadHistory returns the update history of the service, oldest first.
+func ReadHistory(svc *ServiceConfig) ([]HistoryEntry, error) {
+	f, err := os.Open(svc.HistoryFile())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history file: %w", err)
+	}
+	defer f.Close()
+
+	var entries []HistoryEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry HistoryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,155 @@
+package updater
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+)
+
+// ComputeSHA256 computes the SHA256 of a file.
+func ComputeSHA256(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	// This reads the file in chunks to handle large files efficiently
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", fmt.Errorf("failed to compute hash: %w", err)
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// Unzip extracts a .zip into the dest folder.
+func Unzip(src, dest string) error {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	// Closure to address file descriptors issue with all the deferred .Close() methods
+	extractAndWriteFile := func(f *zip.File) error {
+		path := filepath.Join(dest, f.Name)
+
+		// Check for ZipSlip (Directory traversal)
+		if !strings.HasPrefix(path, filepath.Clean(dest)+string(os.PathSeparator)) {
+			return fmt.Errorf("illegal file path: %s", path)
+		}
+
+		if f.FileInfo().IsDir() {
+			return os.MkdirAll(path, f.Mode())
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		if _, err := io.Copy(out, rc); err != nil {
+			return err
+		}
+		return out.Close()
+	}
+
+	for _, f := range r.File {
+		if err := extractAndWriteFile(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reloadAndRestartUnit reloads systemd and restarts the unit.
+func reloadAndRestartUnit(ctx context.Context, unitName string) error {
+	// Connect to systemd via D-Bus using the context-aware method
+	conn, err := dbus.NewSystemConnectionContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to system bus: %w", err)
+	}
+	defer conn.Close()
+
+	if err := conn.ReloadContext(ctx); err != nil {
+		return fmt.Errorf("failed to reload systemd: %w", err)
+	}
+
+	if _, err := conn.RestartUnitContext(ctx, unitName, "replace", nil); err != nil {
+		return fmt.Errorf("failed to restart unit %s: %w", unitName, err)
+	}
+	return nil
+}
+
+// updateSymlink atomically points linkName to newTarget: a temporary link is created
+// next to it and renamed over it, so linkName never goes missing.
+func updateSymlink(newTarget, linkName string) error {
+	tmp := fmt.Sprintf("%s.tmp-%d", linkName, os.Getpid())
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale temporary symlink: %w", err)
+	}
+	if err := os.Symlink(newTarget, tmp); err != nil {
+		return fmt.Errorf("failed to create symlink: %w", err)
+	}
+	if err := os.Rename(tmp, linkName); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to replace symlink: %w", err)
+	}
+	return syncDir(filepath.Dir(linkName))
+}
+
+// installedVersion returns the version the first link of the service points to, or
+// an empty string when the service has never been installed.
+func installedVersion(svc *ServiceConfig) (string, error) {
+	target, err := os.Readlink(svc.Links[0].Name)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read service symlink: %w", err)
+	}
+
+	rel, err := filepath.Rel(svc.InstallDir, target)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("service symlink %s points outside of %s", target, svc.InstallDir)
+	}
+	return strings.Split(rel, string(os.PathSeparator))[0], nil
+}
+
+// listVersions returns the versioned folders found in the install directory of the service.
+func listVersions(svc *ServiceConfig) ([]string, error) {
+	entries, err := os.ReadDir(svc.InstallDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	var versions []string
+	for _, entry := range entries {
+		if entry.IsDir() && versionRegex.MatchString(entry.Name()) {
+			versions = append(versions, entry.Name())
+		}
+	}
+	return versions, nil
+}
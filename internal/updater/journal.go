@@ -0,0 +1,270 @@
+package updater
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// JournalFileName is the name of the install journal in the install folder of a service,
+// next to its status file.
+const JournalFileName = "install_journal.json"
+
+// Steps of an install transaction recorded in the journal.
+const (
+	// stepInstalling: the version is being unzipped next to its folder, the links still point to the previous version.
+	stepInstalling = "installing"
+	// stepSwitching: the links are being pointed to the new version and the unit restarted.
+	stepSwitching = "switching"
+	// stepConfirming: the process started after the restart is confirming that the new version is healthy.
+	stepConfirming = "confirming"
+	// stepRollingBack: the links are being pointed back to the previous version and the unit restarted.
+	stepRollingBack = "rolling_back"
+	// stepCommitted: the new version is healthy, the old versions are being deleted.
+	stepCommitted = "committed"
+)
+
+// journal records how far an install transaction of a service got, so that an interrupted
+// install is finished or undone when the daemon starts again.
+type journal struct {
+	Version         string `json:"version"`
+	PreviousVersion string `json:"previous_version"`
+	Step            string `json:"step"`
+	// Retained is set when Version was already installed, as in a rollback, and must be kept.
+	Retained bool `json:"retained,omitempty"`
+	// Rollback is set when Version is the target of a rollback requested by an operator.
+	Rollback bool `json:"rollback,omitempty"`
+	// Restarted is set once the links are switched, right before the unit is restarted.
+	Restarted bool `json:"restarted,omitempty"`
+}
+
+// JournalFile returns the file where the install transaction in progress is recorded.
+func (s *ServiceConfig) JournalFile() string {
+	return filepath.Join(s.InstallDir, JournalFileName)
+}
+
+// writeJournal durably replaces the journal of the service.
+func writeJournal(svc *ServiceConfig, j *journal) error {
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(svc.JournalFile(), data, 0644); err != nil {
+		return fmt.Errorf("failed to write install journal: %w", err)
+	}
+	publishStatus()
+	return nil
+}
+
+// readJournal returns the journal of the service, or nil when no install is in progress.
+func readJournal(svc *ServiceConfig) (*journal, error) {
+	data, err := os.ReadFile(svc.JournalFile())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read install journal: %w", err)
+	}
+	var j journal
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, fmt.Errorf("failed to parse install journal: %w", err)
+	}
+	return &j, nil
+}
+
+// clearJournal ends the install transaction of the service.
+func clearJournal(svc *ServiceConfig) error {
+	if err := os.Remove(svc.JournalFile()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove install journal: %w", err)
+	}
+	publishStatus()
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file that is synced and renamed over name.
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(name))
+}
+
+// syncDir flushes the entries of a directory, making the renames done in it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Recover finishes or undoes the install transaction interrupted by a crash, a power loss
+// or the restart of the unit the updater runs in, so that the service ends up running either
+// the previous or the new version:
+//   - interrupted while installing, the partial version folder is deleted, never the
+//     version folder;
+//   - interrupted while switching, once the links point to the new version it is confirmed
+//     healthy and committed, as the restart of the unit is what stops an updater running in
+//     it. The unit is restarted first unless the journal records that it was. It is rolled
+//     back only when the confirmation fails or times out, or when the links were not switched;
+//   - interrupted while confirming or rolling back, the new version went down, so the links
+//     are pointed back to the previous version;
+//   - interrupted after the commit, the deletion of the old versions is completed.
+//
+// It takes the lock of the service, so that a CLI command in the middle of a transaction in
+// another process finishes it first.
+func (u *Updater) Recover(ctx context.Context) error {
+	unlock, err := lockService(u.svc)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	j, err := readJournal(u.svc)
+	if err != nil || j == nil {
+		return err
+	}
+	u.log.Info("Recovering an interrupted install", "service", u.svc.Name, "version", j.Version, "previous", j.PreviousVersion, "step", j.Step)
+
+	switch j.Step {
+	case stepInstalling:
+		// Only the partial folder is deleted: the version folder is either complete or was already retained
+		os.Remove(u.svc.ArchivePath())
+		if err := os.RemoveAll(u.svc.partialVersionDir(j.Version)); err != nil {
+			return fmt.Errorf("failed to delete the partial version %s: %w", j.Version, err)
+		}
+		u.record(HistoryEntry{Version: j.Version, PreviousVersion: j.PreviousVersion, Result: ResultFailed, Error: "install interrupted"})
+	case stepSwitching:
+		switched := u.linksPointTo(j.Version)
+		if !switched && j.PreviousVersion != "" {
+			return u.recoverRollback(ctx, j, "activation interrupted")
+		}
+		if !switched || !j.Restarted {
+			// The updater stopped before restarting the unit: the new version never ran
+			if err := u.switchTo(ctx, j.Version, j); err != nil {
+				return fmt.Errorf("failed to switch to %s: %w", j.Version, err)
+			}
+		}
+		return u.confirm(ctx, j)
+	case stepConfirming:
+		return u.recoverRollback(ctx, j, "new version stopped before being confirmed healthy")
+	case stepRollingBack:
+		return u.recoverRollback(ctx, j, "rollback interrupted")
+	case stepCommitted:
+		u.prune(j.Version, j.PreviousVersion)
+	default:
+		return fmt.Errorf("unknown install journal step %q", j.Step)
+	}
+
+	u.log.Info("✅ Interrupted install recovered", "service", u.svc.Name)
+	return clearJournal(u.svc)
+}
+
+// linksPointTo reports whether all the links of the service point to the version.
+func (u *Updater) linksPointTo(version string) bool {
+	dir := u.svc.VersionDir(version)
+	for _, link := range u.svc.Links {
+		target, err := os.Readlink(link.Name)
+		if err != nil || target != filepath.Join(dir, filepath.FromSlash(link.Target)) {
+			return false
+		}
+	}
+	return true
+}
+
+// confirm checks the health of the version the unit was restarted with and commits the
+// transaction. The journal is moved to stepConfirming first: if the new version goes down
+// during the check, taking an updater running in its unit with it, the next start rolls back.
+func (u *Updater) confirm(ctx context.Context, j *journal) error {
+	confirming := *j
+	confirming.Step = stepConfirming
+	if err := writeJournal(u.svc, &confirming); err != nil {
+		return err
+	}
+	u.log.Info("Confirming the restarted version", "service", u.svc.Name, "version", j.Version)
+
+	if err := waitHealthy(ctx, u.svc, u.cfg.HealthTimeout, u.cfg.HealthStablePeriod); err != nil {
+		if ctx.Err() != nil {
+			// Shutting down: the version is confirmed again on the next start
+			writeJournal(u.svc, j)
+			return err
+		}
+		if j.PreviousVersion == "" {
+			u.record(HistoryEntry{Version: j.Version, Result: ResultFailed, Error: err.Error()})
+			return clearJournal(u.svc)
+		}
+		return u.recoverRollback(ctx, j, err.Error())
+	}
+
+	u.log.Info("✅ Service healthy", "unit", u.svc.Unit, "version", j.Version)
+	if j.Rollback {
+		u.rejectVersion(j.PreviousVersion)
+		u.record(HistoryEntry{Version: j.Version, PreviousVersion: j.PreviousVersion, Result: ResultRollback})
+		u.writeInventory()
+		return clearJournal(u.svc)
+	}
+	if err := writeJournal(u.svc, &journal{Version: j.Version, PreviousVersion: j.PreviousVersion, Step: stepCommitted}); err != nil {
+		return err
+	}
+	u.record(HistoryEntry{Version: j.Version, PreviousVersion: j.PreviousVersion, Result: ResultInstalled})
+	u.prune(j.Version, j.PreviousVersion)
+	return clearJournal(u.svc)
+}
+
+// recoverRollback points the links back to the previous version and restarts the unit, unless
+// the journal records that the restart of the rollback is what interrupted it, and deletes the
+// new version unless it was retained.
+func (u *Updater) recoverRollback(ctx context.Context, j *journal, reason string) error {
+	if j.PreviousVersion == "" {
+		u.record(HistoryEntry{Version: j.Version, Result: ResultFailed, Error: reason})
+		return clearJournal(u.svc)
+	}
+	if j.Step != stepRollingBack || !j.Restarted || !u.linksPointTo(j.PreviousVersion) {
+		rollingBack := *j
+		rollingBack.Step = stepRollingBack
+		rollingBack.Restarted = false
+		if err := writeJournal(u.svc, &rollingBack); err != nil {
+			return err
+		}
+		if err := u.switchTo(ctx, j.PreviousVersion, &rollingBack); err != nil {
+			return fmt.Errorf("failed to switch back to %s: %w", j.PreviousVersion, err)
+		}
+	}
+	if !j.Retained {
+		if err := os.RemoveAll(u.svc.VersionDir(j.Version)); err != nil {
+			u.log.Error(err, "Error deleting the interrupted version folder", "version", j.Version)
+		}
+		u.removeTargets(j.Version)
+	}
+	u.log.Info("↩️ Rolled back", "service", u.svc.Name, "version", j.PreviousVersion)
+	u.writeInventory()
+	u.record(HistoryEntry{Version: j.Version, PreviousVersion: j.PreviousVersion, Result: ResultRolledBack, Error: reason})
+	return clearJournal(u.svc)
+}
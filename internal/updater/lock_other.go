@@ -0,0 +1,8 @@
+//go:build !unix
+
+package updater
+
+// lockFile is not supported without flock: only the updates of one process are serialized.
+func lockFile(_ string) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,249 @@
+package updater
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+	"github.com/theupdateframework/go-tuf/v2/metadata/config"
+	"github.com/theupdateframework/go-tuf/v2/metadata/fetcher"
+	"github.com/theupdateframework/go-tuf/v2/metadata/trustedmetadata"
+	"github.com/theupdateframework/go-tuf/v2/metadata/updater"
+)
+
+// IndexInfo is the structure in which the information of a service from its <service>-index.json is stored.
+type IndexInfo struct {
+	Bytes  string `json:"bytes"`
+	Path   string `json:"path"`
+	Hashes struct {
+		Sha256 string `json:"sha256"`
+	} `json:"hashes"`
+	Version     string   `json:"version"`
+	ReleaseDate string   `json:"release-date"`
+	Rollout     *Rollout `json:"rollout,omitempty"`
+	// Critical marks the releases installed automatically under the critical auto-update policy.
+	Critical bool `json:"critical,omitempty"`
+}
+
+// metadataMu serializes the refreshes of the TUF metadata shared by all the services.
+var metadataMu sync.Mutex
+
+// MetadataLockFileName is the name of the lock file in the install folder, locked while the
+// TUF metadata is refreshed so that the CLI commands running in another process wait for the daemon.
+const MetadataLockFileName = ".metadata.lock"
+
+// lockMetadata serializes the refreshes of the TUF metadata, within the process with
+// metadataMu and across processes with the metadata lock file.
+func lockMetadata(cfg *Config) (func(), error) {
+	metadataMu.Lock()
+	unlock, err := lockFile(filepath.Join(cfg.InstallDir, MetadataLockFileName))
+	if err != nil {
+		metadataMu.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlock()
+		metadataMu.Unlock()
+	}, nil
+}
+
+// InitEnvironment prepares the local environment for TUF - metadata and targets folders.
+func InitEnvironment(cfg *Config) (string, error) {
+	tmpDir := cfg.MetadataDir()
+	if err := os.MkdirAll(tmpDir, 0750); err != nil {
+		return "", fmt.Errorf("failed to create the metadata folder: %w", err)
+	}
+	if err := os.MkdirAll(cfg.TargetsDir(), 0750); err != nil {
+		return "", fmt.Errorf("failed to create the targets folder: %w", err)
+	}
+	return tmpDir, nil
+}
+
+// newTUFUpdater creates a TUF Updater storing the targets in targetsDir and refreshes the
+// top-level metadata. The roots verified by the refresh are archived for the mirror. A nil
+// fetcher downloads from the remote repository. The caller must hold the metadata lock.
+func newTUFUpdater(cfg *Config, targetsDir, metadataDir string, f fetcher.Fetcher) (*updater.Updater, error) {
+	rootBytes, err := os.ReadFile(filepath.Join(metadataDir, "root.json"))
+	if err != nil {
+		return nil, err
+	}
+	tufCfg, err := config.New(cfg.MetadataURL, rootBytes)
+	if err != nil {
+		return nil, err
+	}
+	tufCfg.LocalMetadataDir = metadataDir
+	tufCfg.LocalTargetsDir = targetsDir
+	tufCfg.RemoteTargetsURL = cfg.TargetsURL
+	tufCfg.PrefixTargetsWithHash = true
+	if f != nil {
+		tufCfg.Fetcher = f
+	}
+	roots := &rootRecorder{Fetcher: tufCfg.Fetcher, prefix: ensureTrailingSlash(cfg.MetadataURL), roots: map[int64][]byte{}}
+	tufCfg.Fetcher = roots
+
+	up, err := updater.New(tufCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create updater: %w", err)
+	}
+	if err = up.Refresh(); err != nil {
+		return nil, fmt.Errorf("failed to refresh metadata: %w", err)
+	}
+	if err := roots.archive(cfg, up.GetTrustedMetadataSet().Root.Signed.Version); err != nil {
+		return nil, fmt.Errorf("failed to archive the root metadata: %w", err)
+	}
+	return up, nil
+}
+
+// DownloadTargetIndex downloads the index of the service using the TUF Updater. The Updater refreshes
+// the top-level metadata, gets the target information, verifies if the target is already cached, and
+// in case it is not cached, downloads the target file. It returns 1 when the index was found in the
+// cache and 0 when a new one has been downloaded. A nil fetcher downloads from the remote repository.
+func DownloadTargetIndex(cfg *Config, svc *ServiceConfig, metadataDir string, f fetcher.Fetcher) ([]byte, int, error) {
+	unlock, err := lockMetadata(cfg)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer unlock()
+
+	serviceFilePath := svc.Index
+	up, err := newTUFUpdater(cfg, svc.targetsDir, metadataDir, f)
+	if err != nil {
+		return nil, 0, err
+	}
+	ti, err := up.GetTargetInfo(serviceFilePath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("getting info for target index %q: %w", serviceFilePath, err)
+	}
+	targetPath := svc.IndexFile()
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0750); err != nil {
+		return nil, 0, fmt.Errorf("failed to create the index folder: %w", err)
+	}
+	path, tb, err := up.FindCachedTarget(ti, targetPath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error checking cache: %w", err)
+	}
+	if path != "" {
+		return tb, 1, nil
+	}
+	_, tb, err = up.DownloadTarget(ti, targetPath, "")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to download target index %s: %w", svc.Name, err)
+	}
+	return tb, 0, nil
+}
+
+// ErrTargetNotFound is returned when an artifact is not published as a TUF target.
+var ErrTargetNotFound = errors.New("artifact is not a TUF target")
+
+// ArtifactTarget is the signed TUF targets information of an artifact.
+type ArtifactTarget struct {
+	// Path is the target path.
+	Path string
+	// RemotePath is the location of the artifact relative to the targets URL.
+	RemotePath string
+	Length     int64
+	SHA256     string
+}
+
+// GetArtifactTarget returns the signed length, hash and location of the artifact published
+// as the TUF target targetPath, walking the delegated roles like the index. The artifact is
+// not fetched through the TUF Updater, which holds whole targets in memory and bounds their
+// download time, but staged and verified against the returned information.
+func GetArtifactTarget(cfg *Config, svc *ServiceConfig, metadataDir string, f fetcher.Fetcher, targetPath string) (*ArtifactTarget, error) {
+	unlock, err := lockMetadata(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	up, err := newTUFUpdater(cfg, svc.targetsDir, metadataDir, f)
+	if err != nil {
+		return nil, err
+	}
+	ti, err := up.GetTargetInfo(targetPath)
+	if err != nil {
+		// go-tuf does not type the error of a missing target, so the roles it walked are checked
+		if targetMissing(up.GetTrustedMetadataSet(), targetPath) {
+			return nil, fmt.Errorf("%w: %s", ErrTargetNotFound, targetPath)
+		}
+		return nil, fmt.Errorf("getting info for target artifact %q: %w", targetPath, err)
+	}
+	hash, ok := ti.Hashes["sha256"]
+	if !ok {
+		return nil, fmt.Errorf("target artifact %q has no sha256 hash", targetPath)
+	}
+
+	target := &ArtifactTarget{
+		Path:       targetPath,
+		RemotePath: targetPath,
+		Length:     ti.Length,
+		SHA256:     hex.EncodeToString(hash),
+	}
+	if up.GetTrustedMetadataSet().Root.Signed.ConsistentSnapshot {
+		dir, base := path.Split(targetPath)
+		target.RemotePath = dir + target.SHA256 + "." + base
+	}
+	return target, nil
+}
+
+// targetMissing reports whether targetPath is in none of the targets roles delegated the
+// path, walked in the order of the TUF updater. It is false when one of the roles could
+// not be loaded, as the target may be listed there.
+func targetMissing(trusted trustedmetadata.TrustedMetadata, targetPath string) bool {
+	toVisit := []string{metadata.TARGETS}
+	visited := map[string]bool{}
+	for len(toVisit) > 0 {
+		role := toVisit[len(toVisit)-1]
+		toVisit = toVisit[:len(toVisit)-1]
+		if visited[role] {
+			continue
+		}
+		visited[role] = true
+		targets, ok := trusted.Targets[role]
+		if !ok {
+			return false
+		}
+		if _, ok := targets.Signed.Targets[targetPath]; ok {
+			return false
+		}
+		if targets.Signed.Delegations == nil {
+			continue
+		}
+		var children []string
+		for _, child := range targets.Signed.Delegations.GetRolesForTarget(targetPath) {
+			children = append(children, child.Name)
+			if child.Terminating {
+				toVisit = nil
+				break
+			}
+		}
+		for i := len(children) - 1; i >= 0; i-- {
+			toVisit = append(toVisit, children[i])
+		}
+	}
+	return true
+}
+
+// parseIndex parses the information of the service from the content of its index.
+func parseIndex(service string, content []byte) (*IndexInfo, error) {
+	var data map[string]IndexInfo
+	if err := json.Unmarshal(content, &data); err != nil {
+		return nil, fmt.Errorf("error parsing the index: %w", err)
+	}
+	info, ok := data[service]
+	if !ok {
+		return nil, fmt.Errorf("service %s not found in the index", service)
+	}
+	if info.Rollout != nil {
+		if err := info.Rollout.validate(); err != nil {
+			return nil, fmt.Errorf("error parsing the index of %s: %w", service, err)
+		}
+	}
+	return &info, nil
+}
@@ -0,0 +1,46 @@
+package updater
+
+import (
+	"testing"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+	"github.com/theupdateframework/go-tuf/v2/metadata/trustedmetadata"
+)
+
+func TestTargetMissing(t *testing.T) {
+	top := metadata.Targets()
+	top.Signed.Targets["index.json"] = &metadata.TargetFiles{Length: 1}
+	top.Signed.Delegations = &metadata.Delegations{
+		Keys: map[string]*metadata.Key{},
+		Roles: []metadata.DelegatedRole{
+			{Name: "apps", Threshold: 1, Paths: []string{"apps/*"}},
+			{Name: "late", Threshold: 1, Paths: []string{"late/*"}},
+		},
+	}
+	apps := metadata.Targets()
+	apps.Signed.Targets["apps/app.zip"] = &metadata.TargetFiles{Length: 1}
+	// The late role failed to load
+	trusted := trustedmetadata.TrustedMetadata{Targets: map[string]*metadata.Metadata[metadata.TargetsType]{
+		metadata.TARGETS: top,
+		"apps":           apps,
+	}}
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"index.json", false},
+		{"apps/app.zip", false},
+		{"apps/other.zip", true},
+		{"other/app.zip", true},
+		{"late/app.zip", false},
+	}
+	for _, tt := range tests {
+		if got := targetMissing(trusted, tt.path); got != tt.want {
+			t.Errorf("targetMissing(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+	if !targetMissing(trustedmetadata.TrustedMetadata{Targets: map[string]*metadata.Metadata[metadata.TargetsType]{metadata.TARGETS: metadata.Targets()}}, "app.zip") {
+		t.Error("targetMissing() = false for a repository without delegations")
+	}
+}
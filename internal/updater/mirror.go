@@ -0,0 +1,195 @@
+package updater
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+	"github.com/theupdateframework/go-tuf/v2/metadata/fetcher"
+)
+
+// The mirror serves the metadata under /metadata/ and the targets under /targets/, so
+// that other nodes use http://<mirror-addr>/metadata and /targets as their TUF URLs.
+const (
+	mirrorMetadataPrefix = "/metadata/"
+	mirrorTargetsPrefix  = "/targets/"
+)
+
+// RootsDir is the folder where every trusted root version is kept, so that the
+// mirror can serve the whole root chain to clients that trust an older root.
+func (c *Config) RootsDir() string {
+	return filepath.Join(c.MetadataDir(), "roots")
+}
+
+// archiveRoot stores a trusted root version in the roots folder.
+func archiveRoot(cfg *Config, data []byte) error {
+	version, err := metadataVersion(data)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cfg.RootsDir(), 0750); err != nil {
+		return fmt.Errorf("failed to create the roots folder: %w", err)
+	}
+	return os.WriteFile(filepath.Join(cfg.RootsDir(), fmt.Sprintf("%d.root.json", version)), data, 0644)
+}
+
+// metadataVersion returns the version of a TUF metadata file.
+func metadataVersion(data []byte) (int64, error) {
+	var md struct {
+		Signed struct {
+			Version int64 `json:"version"`
+		} `json:"signed"`
+	}
+	if err := json.Unmarshal(data, &md); err != nil {
+		return 0, fmt.Errorf("failed to parse metadata: %w", err)
+	}
+	return md.Signed.Version, nil
+}
+
+// rootRecorder wraps a fetcher and keeps the root versions downloaded during a refresh.
+// They are only archived once the refresh has verified them.
+type rootRecorder struct {
+	fetcher.Fetcher
+	prefix string
+
+	mu    sync.Mutex
+	roots map[int64][]byte
+}
+
+func (f *rootRecorder) DownloadFile(urlPath string, maxLength int64, timeout time.Duration) ([]byte, error) {
+	data, err := f.Fetcher.DownloadFile(urlPath, maxLength, timeout)
+	if err != nil {
+		return nil, err
+	}
+	name, ok := strings.CutPrefix(urlPath, f.prefix)
+	if version, found := strings.CutSuffix(name, ".root.json"); ok && found {
+		if v, err := strconv.ParseInt(version, 10, 64); err == nil {
+			f.mu.Lock()
+			f.roots[v] = data
+			f.mu.Unlock()
+		}
+	}
+	return data, nil
+}
+
+// archive stores the recorded roots up to the trusted version.
+func (f *rootRecorder) archive(cfg *Config, trusted int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for version, data := range f.roots {
+		if version > trusted {
+			continue
+		}
+		if err := archiveRoot(cfg, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MirrorHandler serves the TUF metadata and the targets this node has already verified,
+// laid out as in the remote repository. Mirror clients verify everything against their
+// own trusted root, so the mirror does not need to be trusted.
+func MirrorHandler(cfg *Config) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(mirrorMetadataPrefix, func(w http.ResponseWriter, r *http.Request) {
+		serveMirrorMetadata(w, r, cfg, strings.TrimPrefix(r.URL.Path, mirrorMetadataPrefix))
+	})
+	mux.HandleFunc(mirrorTargetsPrefix, func(w http.ResponseWriter, r *http.Request) {
+		serveMirrorTarget(w, r, cfg, strings.TrimPrefix(r.URL.Path, mirrorTargetsPrefix))
+	})
+	return mux
+}
+
+// serveMirrorMetadata serves <role>.json and <version>.<role>.json. Versioned files are
+// only served when the local copy has that version, except for the archived roots.
+func serveMirrorMetadata(w http.ResponseWriter, r *http.Request, cfg *Config, name string) {
+	if !filepath.IsLocal(name) || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	var version int64
+	role := strings.TrimSuffix(name, ".json")
+	if prefix, rest, ok := strings.Cut(role, "."); ok {
+		if v, err := strconv.ParseInt(prefix, 10, 64); err == nil {
+			version, role = v, rest
+		}
+	}
+
+	file := filepath.Join(cfg.MetadataDir(), role+".json")
+	if role == metadata.ROOT && version > 0 {
+		file = filepath.Join(cfg.RootsDir(), name)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if version > 0 {
+		if v, err := metadataVersion(data); err != nil || v != version {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// serveMirrorTarget serves the cached targets, either by their plain path or by the
+// <sha256>.<name> path used with consistent snapshots.
+func serveMirrorTarget(w http.ResponseWriter, r *http.Request, cfg *Config, name string) {
+	if !filepath.IsLocal(name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	dir, base := path.Split(name)
+	hash, plain, prefixed := strings.Cut(base, ".")
+	if prefixed && len(hash) == 64 {
+		file := filepath.Join(cfg.TargetsDir(), filepath.FromSlash(dir+plain))
+		if sum, err := ComputeSHA256(file); err == nil && sum == hash {
+			http.ServeFile(w, r, file)
+			return
+		}
+	}
+
+	file := filepath.Join(cfg.TargetsDir(), filepath.FromSlash(name))
+	if info, err := os.Stat(file); err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, file)
+}
+
+// runMirror serves the verified metadata and targets on cfg.MirrorAddr until ctx is done.
+func runMirror(ctx context.Context, cfg *Config, log metadata.Logger) error {
+	srv := &http.Server{
+		Addr:              cfg.MirrorAddr,
+		Handler:           MirrorHandler(cfg),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Info("🪞 Serving the TUF mirror", "addr", cfg.MirrorAddr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("mirror server: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package updater
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/stdr"
+)
+
+func TestMirrorServesKeptTargets(t *testing.T) {
+	cfg := &Config{InstallDir: t.TempDir()}
+	svc := &ServiceConfig{Name: "svc", ArtifactTarget: "svc/svc-{version}.zip"}
+	u := &Updater{cfg: cfg, svc: svc, log: stdr.New(nil)}
+
+	content := []byte("artifact")
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+	artifact := filepath.Join(t.TempDir(), "svc.zip")
+	if err := os.WriteFile(artifact, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	version := "v2025.03.14-sha.1a2b3c4"
+	target := &ArtifactTarget{
+		Path:       svc.artifactTargetPath(version),
+		RemotePath: "svc/" + hash + ".svc-" + version + ".zip",
+		Length:     int64(len(content)),
+		SHA256:     hash,
+	}
+	if err := u.keepTarget(artifact, target); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(MirrorHandler(cfg))
+	defer srv.Close()
+	get := func() int {
+		resp, err := http.Get(srv.URL + mirrorTargetsPrefix + target.RemotePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode == http.StatusOK && string(body) != string(content) {
+			t.Fatalf("mirror served %q, want %q", body, content)
+		}
+		return resp.StatusCode
+	}
+	if code := get(); code != http.StatusOK {
+		t.Fatalf("mirror answered %d, want %d", code, http.StatusOK)
+	}
+
+	u.removeTargets(version)
+	if code := get(); code != http.StatusNotFound {
+		t.Fatalf("mirror answered %d after removal, want %d", code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,156 @@
+package updater
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Retention is the policy deciding which installed versions of a service are kept.
+// A version is kept when any of the rules keeps it.
+type Retention struct {
+	// KeepLast keeps the most recent versions.
+	KeepLast int
+	// KeepFor keeps the versions released less than KeepFor ago, when positive.
+	KeepFor time.Duration
+	// Pinned versions are never deleted.
+	Pinned []string
+}
+
+// retention returns the retention policy of the service.
+func (c *Config) retention(svc *ServiceConfig) Retention {
+	return Retention{
+		KeepLast: c.KeepVersions,
+		KeepFor:  time.Duration(c.KeepDays) * 24 * time.Hour,
+		Pinned:   svc.Pinned,
+	}
+}
+
+// prune deletes the installed versions of the service that the retention policy does not keep.
+// The active version and the fallback are always kept. It returns the deleted versions.
+func prune(svc *ServiceConfig, r Retention, active, fallback string, now time.Time) ([]string, error) {
+	names, err := listVersions(svc)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]Version, 0, len(names))
+	for _, name := range names {
+		if v, err := ParseVersion(name); err == nil {
+			versions = append(versions, v)
+		}
+	}
+	// Most recent first
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].Newer(versions[j]) })
+
+	var (
+		removed []string
+		errs    []error
+	)
+	for i, v := range versions {
+		tag := v.String()
+		switch {
+		case tag == active, tag == fallback:
+		case i < r.KeepLast:
+		case r.KeepFor > 0 && now.Sub(v.Date) < r.KeepFor:
+		case slices.Contains(r.Pinned, tag):
+		default:
+			if err := os.RemoveAll(svc.VersionDir(tag)); err != nil {
+				errs = append(errs, fmt.Errorf("failed to delete version %s: %w", tag, err))
+				continue
+			}
+			removed = append(removed, tag)
+		}
+	}
+	if len(errs) > 0 {
+		return removed, fmt.Errorf("prune %s: %v", svc.Name, errs)
+	}
+	return removed, nil
+}
+
+// InstalledVersion describes a version of a service found in its install directory.
+type InstalledVersion struct {
+	Version     string    `json:"version"`
+	Active      bool      `json:"active"`
+	Pinned      bool      `json:"pinned"`
+	ReleaseDate time.Time `json:"release_date"`
+	InstalledAt time.Time `json:"installed_at"`
+}
+
+// ServiceInventory lists the installed versions of a service, most recent first.
+type ServiceInventory struct {
+	Service  string             `json:"service"`
+	Channel  string             `json:"channel"`
+	Active   string             `json:"active"`
+	Versions []InstalledVersion `json:"versions"`
+}
+
+// Inventory returns the versions of the service installed on the host.
+func Inventory(svc *ServiceConfig) (*ServiceInventory, error) {
+	active, err := installedVersion(svc)
+	if err != nil {
+		return nil, err
+	}
+	names, err := listVersions(svc)
+	if err != nil {
+		return nil, err
+	}
+
+	inv := &ServiceInventory{Service: svc.Name, Channel: svc.Channel, Active: active, Versions: []InstalledVersion{}}
+	for _, name := range names {
+		v, err := ParseVersion(name)
+		if err != nil {
+			continue
+		}
+		iv := InstalledVersion{
+			Version:     name,
+			Active:      name == active,
+			Pinned:      slices.Contains(svc.Pinned, name),
+			ReleaseDate: v.Date,
+		}
+		if info, err := os.Stat(svc.VersionDir(name)); err == nil {
+			iv.InstalledAt = info.ModTime().UTC()
+		}
+		inv.Versions = append(inv.Versions, iv)
+	}
+	sort.SliceStable(inv.Versions, func(i, j int) bool {
+		vi, _ := ParseVersion(inv.Versions[i].Version)
+		vj, _ := ParseVersion(inv.Versions[j].Version)
+		return vi.Newer(vj)
+	})
+	return inv, nil
+}
+
+// inventoryMu serializes the writes of the inventory file.
+var inventoryMu sync.Mutex
+
+// WriteInventory writes the installed versions of every service to the inventory file
+// read by the server.
+func WriteInventory(cfg *Config) error {
+	services, err := cfg.LoadServices()
+	if err != nil {
+		return err
+	}
+	inventory := make([]*ServiceInventory, 0, len(services))
+	for _, svc := range services {
+		inv, err := Inventory(svc)
+		if err != nil {
+			return err
+		}
+		inventory = append(inventory, inv)
+	}
+	data, err := json.MarshalIndent(inventory, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	inventoryMu.Lock()
+	defer inventoryMu.Unlock()
+	if err := writeFileAtomic(cfg.InventoryFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write inventory file: %w", err)
+	}
+	return nil
+}
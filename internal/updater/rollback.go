@@ -0,0 +1,218 @@
+package updater
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// ResultRollback is recorded in the history when an operator rolls a service back.
+const ResultRollback = "rollback"
+
+// ErrNoRollbackTarget is returned when there is no retained version to roll back to.
+var ErrNoRollbackTarget = errors.New("no retained version to roll back to")
+
+// RollbackRequest is the content of the rollback file written by the server.
+type RollbackRequest struct {
+	Service string `json:"service"`
+	Version string `json:"version"`
+}
+
+// Rollback points the links of the service to a retained version and restarts the unit.
+// Without a version it goes back to the most recent retained version older than the
+// active one. If the retained version is not healthy, the active one is restored. The
+// version that was active is kept, so the rollback can be undone, but it is not installed
+// automatically again until a newer release appears.
+func (u *Updater) Rollback(ctx context.Context, version string) (*ActivateResult, error) {
+	unlock, err := lockService(u.svc)
+	if err != nil {
+		return nil, u.error(PhaseActivate, err)
+	}
+	defer unlock()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	current, err := installedVersion(u.svc)
+	if err != nil {
+		return nil, u.error(PhaseActivate, err)
+	}
+	if version == "" {
+		if version, err = u.rollbackTarget(current); err != nil {
+			return nil, u.error(PhaseActivate, err)
+		}
+	}
+	if _, err := ParseVersion(version); err != nil {
+		return nil, u.error(PhaseActivate, err)
+	}
+	if version == current {
+		return nil, u.error(PhaseActivate, fmt.Errorf("%s is already the active version", version))
+	}
+	if info, err := os.Stat(u.svc.VersionDir(version)); err != nil || !info.IsDir() {
+		return nil, u.error(PhaseActivate, fmt.Errorf("%w: %s is not installed", ErrNoRollbackTarget, version))
+	}
+
+	u.log.Info("↩️ Rolling back", "service", u.svc.Name, "version", version, "current", current)
+	j := &journal{Version: version, PreviousVersion: current, Step: stepSwitching, Retained: true, Rollback: true}
+	if err := writeJournal(u.svc, j); err != nil {
+		return nil, u.error(PhaseActivate, err)
+	}
+
+	err = u.switchTo(ctx, version, j)
+	if err == nil {
+		err = waitHealthy(ctx, u.svc, u.cfg.HealthTimeout, u.cfg.HealthStablePeriod)
+	}
+	if err != nil && ctx.Err() == nil && current != "" {
+		u.log.Error(err, "❌ Rolled back version is not healthy, restoring the active one", "service", u.svc.Name, "version", version)
+		restoring := &journal{Version: version, PreviousVersion: current, Step: stepRollingBack, Retained: true, Rollback: true}
+		writeJournal(u.svc, restoring)
+		if restoreErr := u.switchTo(ctx, current, restoring); restoreErr != nil {
+			err = fmt.Errorf("%w: restoring %s failed: %w", err, current, restoreErr)
+		} else {
+			clearJournal(u.svc)
+		}
+	}
+	if err != nil {
+		u.record(HistoryEntry{Version: version, PreviousVersion: current, Result: ResultFailed, Error: err.Error()})
+		u.writeInventory()
+		return nil, u.error(PhaseHealth, err)
+	}
+
+	if err := clearJournal(u.svc); err != nil {
+		return nil, u.error(PhaseActivate, err)
+	}
+	u.rejectVersion(current)
+	u.record(HistoryEntry{Version: version, PreviousVersion: current, Result: ResultRollback})
+	u.writeInventory()
+	u.log.Info("✅ Rolled back", "service", u.svc.Name, "version", version, "previous", current)
+	return &ActivateResult{Version: version, PreviousVersion: current}, nil
+}
+
+// startRollback checks that the rollback requested through the control API has a target
+// and runs it in the background, as it lasts until the restarted service is healthy. Its
+// failure is kept for the status.
+func (u *Updater) startRollback(ctx context.Context, version string) error {
+	if version == "" {
+		current, err := installedVersion(u.svc)
+		if err != nil {
+			return err
+		}
+		if _, err := u.rollbackTarget(current); err != nil {
+			return err
+		}
+	} else {
+		if _, err := ParseVersion(version); err != nil {
+			return fmt.Errorf("%w: %w", ErrNoRollbackTarget, err)
+		}
+		if info, err := os.Stat(u.svc.VersionDir(version)); err != nil || !info.IsDir() {
+			return fmt.Errorf("%w: %s is not installed", ErrNoRollbackTarget, version)
+		}
+	}
+
+	go func() {
+		if _, err := u.Rollback(ctx, version); err != nil {
+			u.recordError(err)
+			u.log.Error(err, "❌ Rollback failed", "service", u.svc.Name)
+		}
+	}()
+	return nil
+}
+
+// rollbackTarget returns the most recent retained version older than the active one.
+func (u *Updater) rollbackTarget(current string) (string, error) {
+	inv, err := Inventory(u.svc)
+	if err != nil {
+		return "", err
+	}
+	active, err := ParseVersion(current)
+	if err != nil {
+		return "", fmt.Errorf("%w: the active version %q is unknown", ErrNoRollbackTarget, current)
+	}
+	// The inventory is sorted most recent first
+	for _, iv := range inv.Versions {
+		if v, err := ParseVersion(iv.Version); err == nil && active.Newer(v) {
+			return iv.Version, nil
+		}
+	}
+	return "", ErrNoRollbackTarget
+}
+
+// RollbackService rolls the named service back to version, or to the previous retained
+// version when version is empty. An empty name stands for the only configured service.
+func RollbackService(ctx context.Context, cfg *Config, service, version string, log metadata.Logger) (*ActivateResult, error) {
+	services, err := cfg.LoadServices()
+	if err != nil {
+		return nil, err
+	}
+	svc, err := findService(services, service)
+	if err != nil {
+		return nil, err
+	}
+	u, err := New(cfg, svc, log)
+	if err != nil {
+		return nil, err
+	}
+	return u.Rollback(ctx, version)
+}
+
+// findService returns the service with the given name, or the only service when name is empty.
+func findService(services []*ServiceConfig, name string) (*ServiceConfig, error) {
+	if name == "" {
+		if len(services) == 1 {
+			return services[0], nil
+		}
+		return nil, errors.New("several services are configured, the service must be given")
+	}
+	for _, svc := range services {
+		if svc.Name == name {
+			return svc, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown service %q", name)
+}
+
+// rollbackLoop reads the rollback file written by the server whenever it changes, and
+// every interval, and runs the requested rollbacks.
+func rollbackLoop(ctx context.Context, cfg *Config, updaters []*Updater, interval time.Duration, log metadata.Logger) {
+	w := newWaiter(ctx, interval, log, cfg.RollbackFile)
+	defer w.stop()
+	for w.wait(ctx) {
+		data, err := os.ReadFile(cfg.RollbackFile)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		// The request is consumed whatever its outcome, so a failing one is not retried forever.
+		os.Remove(cfg.RollbackFile)
+		if err != nil {
+			log.Error(err, "Failed to read the rollback request")
+			continue
+		}
+		var req RollbackRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			log.Error(err, "Failed to parse the rollback request")
+			continue
+		}
+
+		services := make([]*ServiceConfig, 0, len(updaters))
+		for _, u := range updaters {
+			services = append(services, u.svc)
+		}
+		svc, err := findService(services, req.Service)
+		if err != nil {
+			log.Error(err, "❌ Invalid rollback request")
+			continue
+		}
+		for _, u := range updaters {
+			if u.svc != svc {
+				continue
+			}
+			if _, err := u.Rollback(ctx, req.Version); err != nil {
+				log.Error(err, "❌ Rollback failed", "service", svc.Name)
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package updater
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Rollout holds the optional staged rollout parameters of a release in its index. A release
+// reaches Percentage of the fleet from Start, then the percentage of each ramp step once
+// its delay has elapsed. A ramp needs a start, its delays are counted from it. Releases without
+// rollout parameters reach the whole fleet.
+type Rollout struct {
+	Percentage float64       `json:"percentage"`
+	Start      time.Time     `json:"start"`
+	Ramp       []RolloutStep `json:"ramp"`
+}
+
+// RolloutStep raises the percentage of a rollout After the start, e.g. {"after": "24h", "percentage": 50}.
+type RolloutStep struct {
+	After      string  `json:"after"`
+	Percentage float64 `json:"percentage"`
+}
+
+// validate checks the ramp of the rollout when the index is parsed: without a start every step
+// would already be due and the release would reach the whole fleet at once.
+func (r *Rollout) validate() error {
+	if len(r.Ramp) > 0 && r.Start.IsZero() {
+		return errors.New("invalid rollout: a ramp needs a start")
+	}
+	for _, s := range r.Ramp {
+		if _, err := time.ParseDuration(s.After); err != nil {
+			return fmt.Errorf("invalid rollout step %q: %w", s.After, err)
+		}
+	}
+	return nil
+}
+
+// percentage returns the share of the fleet, from 0 to 100, the release is rolled out to at now.
+func (r *Rollout) percentage(now time.Time) (float64, error) {
+	if r == nil {
+		return 100, nil
+	}
+	if !r.Start.IsZero() && now.Before(r.Start) {
+		return 0, nil
+	}
+
+	type step struct {
+		after      time.Duration
+		percentage float64
+	}
+	steps := make([]step, 0, len(r.Ramp))
+	for _, s := range r.Ramp {
+		after, err := time.ParseDuration(s.After)
+		if err != nil {
+			return 0, fmt.Errorf("invalid rollout step %q: %w", s.After, err)
+		}
+		steps = append(steps, step{after, s.Percentage})
+	}
+	sort.Slice(steps, func(i, j int) bool { return steps[i].after < steps[j].after })
+
+	pct := r.Percentage
+	for _, s := range steps {
+		if now.Sub(r.Start) >= s.after {
+			pct = s.percentage
+		}
+	}
+	return min(max(pct, 0), 100), nil
+}
+
+// rolloutBucket places the machine in [0, 100) for a version. The bucket is stable for a
+// machine and a version, and differs between versions so the same machines are not always first.
+func rolloutBucket(machineID, version string) float64 {
+	sum := sha256.Sum256([]byte(machineID + ":" + version))
+	return float64(binary.BigEndian.Uint64(sum[:8])%10000) / 100
+}
+
+// rolloutEligible reports whether the machine is part of the rollout of the release at now.
+func rolloutEligible(index *IndexInfo, machineID string, now time.Time) (bool, error) {
+	pct, err := index.Rollout.percentage(now)
+	if err != nil {
+		return false, err
+	}
+	if pct >= 100 {
+		return true, nil
+	}
+	return rolloutBucket(machineID, index.Version) < pct, nil
+}
+
+// readMachineID returns the stable identity of the machine.
+func readMachineID(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the machine ID: %w", err)
+	}
+	id := strings.TrimSpace(string(data))
+	if id == "" {
+		return "", errors.New("machine ID is empty")
+	}
+	return id, nil
+}
@@ -0,0 +1,112 @@
+package updater
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRolloutPercentage(t *testing.T) {
+	start := time.Date(2025, 3, 14, 12, 0, 0, 0, time.UTC)
+	ramp := &Rollout{
+		Percentage: 10,
+		Start:      start,
+		Ramp:       []RolloutStep{{After: "48h", Percentage: 100}, {After: "24h", Percentage: 50}},
+	}
+	tests := []struct {
+		name    string
+		rollout *Rollout
+		now     time.Time
+		want    float64
+	}{
+		{"no rollout", nil, start, 100},
+		{"before start", ramp, start.Add(-time.Minute), 0},
+		{"at start", ramp, start, 10},
+		{"first step", ramp, start.Add(24 * time.Hour), 50},
+		{"between steps", ramp, start.Add(36 * time.Hour), 50},
+		{"last step", ramp, start.Add(72 * time.Hour), 100},
+		{"percentage without start", &Rollout{Percentage: 25}, start, 25},
+		{"clamped", &Rollout{Percentage: 150}, start, 100},
+		{"negative", &Rollout{Percentage: -5}, start, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.rollout.percentage(tt.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("percentage() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRolloutValidate(t *testing.T) {
+	start := time.Date(2025, 3, 14, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		rollout Rollout
+		ok      bool
+	}{
+		{"percentage only", Rollout{Percentage: 20}, true},
+		{"ramp with start", Rollout{Start: start, Ramp: []RolloutStep{{After: "24h", Percentage: 50}}}, true},
+		{"ramp without start", Rollout{Percentage: 10, Ramp: []RolloutStep{{After: "24h", Percentage: 50}}}, false},
+		{"invalid delay", Rollout{Start: start, Ramp: []RolloutStep{{After: "a day", Percentage: 50}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rollout.validate(); (err == nil) != tt.ok {
+				t.Fatalf("validate() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParseIndexRejectsRampWithoutStart(t *testing.T) {
+	index := []byte(`{"svc": {"version": "v2025.03.14-sha.1a2b3c4", "rollout": {"percentage": 10, "ramp": [{"after": "24h", "percentage": 100}]}}}`)
+	if _, err := parseIndex("svc", index); err == nil {
+		t.Fatal("parseIndex() accepted a ramp without start")
+	}
+}
+
+func TestRolloutBucket(t *testing.T) {
+	const version = "v2025.03.14-sha.1a2b3c4"
+	if a, b := rolloutBucket("machine", version), rolloutBucket("machine", version); a != b {
+		t.Fatalf("rolloutBucket() is not stable: %v, %v", a, b)
+	}
+
+	// The buckets spread over [0, 100), so a percentage reaches about that share of the machines
+	const machines = 10000
+	eligible := 0
+	index := &IndexInfo{Version: version, Rollout: &Rollout{Percentage: 30}}
+	for i := range machines {
+		id := fmt.Sprintf("machine-%d", i)
+		bucket := rolloutBucket(id, version)
+		if bucket < 0 || bucket >= 100 {
+			t.Fatalf("rolloutBucket(%q) = %v, out of [0, 100)", id, bucket)
+		}
+		ok, err := rolloutEligible(index, id, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			eligible++
+		}
+	}
+	if share := float64(eligible) / machines * 100; share < 27 || share > 33 {
+		t.Fatalf("%.1f%% of the machines eligible, want about 30%%", share)
+	}
+
+	// Another version orders the machines differently
+	same := 0
+	for i := range 100 {
+		id := fmt.Sprintf("machine-%d", i)
+		if rolloutBucket(id, version) == rolloutBucket(id, "v2025.03.15-sha.5d6e7f8") {
+			same++
+		}
+	}
+	if same == 100 {
+		t.Fatal("rolloutBucket() does not depend on the version")
+	}
+}
@@ -0,0 +1,253 @@
+package updater
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// maxRootSize bounds the size of a downloaded root metadata file.
+const maxRootSize = 512 * 1024
+
+// trustFiles holds the initial root metadata pinned at build time. Copy the
+// root.json of the TUF repository to trust/root.json before building to embed it.
+//
+//go:embed all:trust
+var trustFiles embed.FS
+
+var (
+	// ErrNoTrustAnchor is returned when there is neither an embedded root, a root
+	// file nor a pin to check a downloaded root against.
+	ErrNoTrustAnchor = errors.New("no pinned root of trust: embed trust/root.json, set --root-file or pin the downloaded root with --root-sha256 or --root-key-id")
+	// ErrUntrustedRoot is returned when the initial root does not match the configured pins.
+	ErrUntrustedRoot = errors.New("root metadata does not match the pinned root of trust")
+)
+
+// InitTrustedRoot initializes the local trusted root metadata. The initial root is,
+// in order of preference, the one embedded in the binary, the one given by --root-file
+// or the 1.root.json of the repository. Whatever its source, it must be self-signed
+// and match the configured fingerprint and key IDs; a downloaded root must be pinned
+// by at least one of them. Bootstrapping fails closed otherwise. A root.json kept from
+// a previous run is checked with verifyTrustedRoot.
+func InitTrustedRoot(cfg *Config, metadataDir string) error {
+	rootPath := filepath.Join(metadataDir, "root.json")
+	if data, err := os.ReadFile(rootPath); err == nil {
+		return verifyTrustedRoot(cfg, data)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to read root.json metadata: %w", err)
+	}
+
+	data, err := loadInitialRoot(cfg)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(rootPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write root.json metadata: %w", err)
+	}
+	return archiveRoot(cfg, data)
+}
+
+// loadInitialRoot returns the initial root metadata once checked against the configured pins.
+func loadInitialRoot(cfg *Config) ([]byte, error) {
+	data, pinned, err := initialRoot(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if !pinned && cfg.RootSHA256 == "" && len(cfg.RootKeyIDs) == 0 {
+		return nil, ErrNoTrustAnchor
+	}
+	if err := verifyRoot(cfg, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// initialRoot returns the initial root metadata and whether it comes from a
+// pinned source (the binary or a local file) rather than from the network.
+func initialRoot(cfg *Config) ([]byte, bool, error) {
+	data, err := trustFiles.ReadFile("trust/root.json")
+	if err == nil {
+		return data, true, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, false, fmt.Errorf("failed to read embedded root: %w", err)
+	}
+
+	if cfg.RootFile != "" {
+		data, err := os.ReadFile(cfg.RootFile)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to read root file: %w", err)
+		}
+		return data, true, nil
+	}
+
+	data, err = downloadRoot(cfg.MetadataURL)
+	if err != nil {
+		return nil, false, err
+	}
+	return data, false, nil
+}
+
+// downloadRoot downloads the 1.root.json of the repository.
+func downloadRoot(metadataURL string) ([]byte, error) {
+	rootURL, err := url.JoinPath(metadataURL, "1.root.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create URL for 1.root.json: %w", err)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(rootURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to GET 1.root.json: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to GET 1.root.json: status code %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRootSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read 1.root.json body: %w", err)
+	}
+	if len(data) > maxRootSize {
+		return nil, fmt.Errorf("1.root.json is larger than %d bytes", maxRootSize)
+	}
+	return data, nil
+}
+
+// verifyRoot checks that data is a self-signed root metadata matching the configured pins.
+func verifyRoot(cfg *Config, data []byte) error {
+	if cfg.RootSHA256 != "" {
+		sum := sha256.Sum256(data)
+		if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got, cfg.RootSHA256) {
+			return fmt.Errorf("%w: sha256 is %s, expected %s", ErrUntrustedRoot, got, cfg.RootSHA256)
+		}
+	}
+
+	root, err := metadata.Root().FromBytes(data)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUntrustedRoot, err)
+	}
+	if err := root.VerifyDelegate(metadata.ROOT, root); err != nil {
+		return fmt.Errorf("%w: %w", ErrUntrustedRoot, err)
+	}
+
+	role, ok := root.Signed.Roles[metadata.ROOT]
+	if !ok {
+		return fmt.Errorf("%w: root role missing", ErrUntrustedRoot)
+	}
+	for _, keyID := range role.KeyIDs {
+		// VerifyDelegate trusts the key listed under an ID, so a root could map a pinned ID to another key
+		key, ok := root.Signed.Keys[keyID]
+		if !ok || key.ID() != keyID {
+			return fmt.Errorf("%w: root key %s does not match its ID", ErrUntrustedRoot, keyID)
+		}
+		if len(cfg.RootKeyIDs) > 0 && !slices.Contains(cfg.RootKeyIDs, keyID) {
+			return fmt.Errorf("%w: root key %s is not pinned", ErrUntrustedRoot, keyID)
+		}
+	}
+	return nil
+}
+
+// verifyTrustedRoot checks the root.json kept from a previous run, which go-tuf replaces
+// with each rotated root. It must be a self-signed root and, when pins are configured,
+// descend through the archived roots from an initial root matching them, so that a
+// root.json replaced on disk is not trusted.
+func verifyTrustedRoot(cfg *Config, data []byte) error {
+	root, err := metadata.Root().FromBytes(data)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUntrustedRoot, err)
+	}
+	if err := root.VerifyDelegate(metadata.ROOT, root); err != nil {
+		return fmt.Errorf("%w: %w", ErrUntrustedRoot, err)
+	}
+	if cfg.RootSHA256 == "" && len(cfg.RootKeyIDs) == 0 {
+		return nil
+	}
+
+	initial, err := initialArchivedRoot(cfg)
+	if err != nil {
+		return err
+	}
+	if root.Signed.Version == initial {
+		return verifyRoot(cfg, data)
+	}
+	if root.Signed.Version < initial {
+		return fmt.Errorf("%w: root.json version %d is older than the initial root", ErrUntrustedRoot, root.Signed.Version)
+	}
+
+	prevData, err := os.ReadFile(filepath.Join(cfg.RootsDir(), fmt.Sprintf("%d.root.json", initial)))
+	if err != nil {
+		return fmt.Errorf("failed to read the initial root: %w", err)
+	}
+	if err := verifyRoot(cfg, prevData); err != nil {
+		return err
+	}
+	prev, err := metadata.Root().FromBytes(prevData)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUntrustedRoot, err)
+	}
+	for version := initial + 1; version <= root.Signed.Version; version++ {
+		next := root
+		if version < root.Signed.Version {
+			nextData, err := os.ReadFile(filepath.Join(cfg.RootsDir(), fmt.Sprintf("%d.root.json", version)))
+			if err != nil {
+				return fmt.Errorf("%w: root version %d is not archived: %w", ErrUntrustedRoot, version, err)
+			}
+			if next, err = metadata.Root().FromBytes(nextData); err != nil {
+				return fmt.Errorf("%w: %w", ErrUntrustedRoot, err)
+			}
+		}
+		// Like a root rotation, each version is signed by the previous one and by itself
+		if next.Signed.Version != version {
+			return fmt.Errorf("%w: archived root %d has version %d", ErrUntrustedRoot, version, next.Signed.Version)
+		}
+		if err := prev.VerifyDelegate(metadata.ROOT, next); err != nil {
+			return fmt.Errorf("%w: root version %d: %w", ErrUntrustedRoot, version, err)
+		}
+		if err := next.VerifyDelegate(metadata.ROOT, next); err != nil {
+			return fmt.Errorf("%w: root version %d: %w", ErrUntrustedRoot, version, err)
+		}
+		prev = next
+	}
+	return nil
+}
+
+// initialArchivedRoot returns the version of the initial root, the oldest archived one.
+func initialArchivedRoot(cfg *Config) (int64, error) {
+	entries, err := os.ReadDir(cfg.RootsDir())
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, fmt.Errorf("failed to read the roots folder: %w", err)
+	}
+	var initial int64
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".root.json")
+		if !ok {
+			continue
+		}
+		version, err := strconv.ParseInt(name, 10, 64)
+		if err != nil || version < 1 {
+			continue
+		}
+		if initial == 0 || version < initial {
+			initial = version
+		}
+	}
+	if initial == 0 {
+		return 0, fmt.Errorf("%w: no archived initial root to check root.json against, remove it to bootstrap again", ErrUntrustedRoot)
+	}
+	return initial, nil
+}
@@ -0,0 +1,174 @@
+package updater
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+func newTestKey(t *testing.T) (*metadata.Key, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := metadata.KeyFromPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, priv
+}
+
+// signRoot adds the signature of priv under keyID to root. The signed payload is the
+// canonical JSON of TUF, which for these roots is the compact JSON with sorted keys
+// written by encoding/json for a generic value.
+func signRoot(t *testing.T, root *metadata.Metadata[metadata.RootType], keyID string, priv ed25519.PrivateKey) {
+	t.Helper()
+	data, err := json.Marshal(root.Signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var signed any
+	if err := dec.Decode(&signed); err != nil {
+		t.Fatal(err)
+	}
+	var payload bytes.Buffer
+	enc := json.NewEncoder(&payload)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(signed); err != nil {
+		t.Fatal(err)
+	}
+	sig := ed25519.Sign(priv, bytes.TrimSuffix(payload.Bytes(), []byte("\n")))
+	root.Signatures = append(root.Signatures, metadata.Signature{KeyID: keyID, Signature: sig})
+}
+
+func rootBytes(t *testing.T, root *metadata.Metadata[metadata.RootType]) []byte {
+	t.Helper()
+	data, err := root.ToBytes(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestVerifyRoot(t *testing.T) {
+	key, priv := newTestKey(t)
+	otherKey, _ := newTestKey(t)
+	attackerKey, attackerPriv := newTestKey(t)
+
+	root := metadata.Root()
+	if err := root.Signed.AddKey(key, metadata.ROOT); err != nil {
+		t.Fatal(err)
+	}
+	signRoot(t, root, key.ID(), priv)
+	valid := rootBytes(t, root)
+	sum := sha256.Sum256(valid)
+
+	unsigned := metadata.Root()
+	if err := unsigned.Signed.AddKey(key, metadata.ROOT); err != nil {
+		t.Fatal(err)
+	}
+
+	// A root mapping the pinned key ID to the key of an attacker, signed by it under that ID
+	substituted := metadata.Root()
+	substituted.Signed.Roles[metadata.ROOT].KeyIDs = []string{key.ID()}
+	substituted.Signed.Keys[key.ID()] = attackerKey
+	signRoot(t, substituted, key.ID(), attackerPriv)
+
+	tests := []struct {
+		name string
+		cfg  Config
+		data []byte
+		ok   bool
+	}{
+		{name: "self-signed", data: valid, ok: true},
+		{name: "sha256 pinned", cfg: Config{RootSHA256: hex.EncodeToString(sum[:])}, data: valid, ok: true},
+		{name: "sha256 mismatch", cfg: Config{RootSHA256: hex.EncodeToString(make([]byte, sha256.Size))}, data: valid},
+		{name: "key pinned", cfg: Config{RootKeyIDs: []string{key.ID()}}, data: valid, ok: true},
+		{name: "key not pinned", cfg: Config{RootKeyIDs: []string{otherKey.ID()}}, data: valid},
+		{name: "unsigned", data: rootBytes(t, unsigned)},
+		{name: "substituted key", cfg: Config{RootKeyIDs: []string{key.ID()}}, data: rootBytes(t, substituted)},
+		{name: "substituted key without pins", data: rootBytes(t, substituted)},
+		{name: "not a root", data: []byte(`{"signed":{"_type":"targets"},"signatures":[]}`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyRoot(&tt.cfg, tt.data)
+			if tt.ok && err != nil {
+				t.Fatalf("verifyRoot() = %v, want nil", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrUntrustedRoot) {
+				t.Fatalf("verifyRoot() = %v, want %v", err, ErrUntrustedRoot)
+			}
+		})
+	}
+}
+
+func TestVerifyTrustedRoot(t *testing.T) {
+	key, priv := newTestKey(t)
+	nextKey, nextPriv := newTestKey(t)
+	attackerKey, attackerPriv := newTestKey(t)
+
+	initial := metadata.Root()
+	if err := initial.Signed.AddKey(key, metadata.ROOT); err != nil {
+		t.Fatal(err)
+	}
+	signRoot(t, initial, key.ID(), priv)
+
+	// The root key is rotated in version 2, signed by the old and the new key
+	rotated := metadata.Root()
+	rotated.Signed.Version = 2
+	if err := rotated.Signed.AddKey(nextKey, metadata.ROOT); err != nil {
+		t.Fatal(err)
+	}
+	signRoot(t, rotated, key.ID(), priv)
+	signRoot(t, rotated, nextKey.ID(), nextPriv)
+
+	forged := metadata.Root()
+	forged.Signed.Version = 2
+	if err := forged.Signed.AddKey(attackerKey, metadata.ROOT); err != nil {
+		t.Fatal(err)
+	}
+	signRoot(t, forged, attackerKey.ID(), attackerPriv)
+
+	tests := []struct {
+		name     string
+		pins     []string
+		archived bool
+		data     []byte
+		ok       bool
+	}{
+		{name: "initial", pins: []string{key.ID()}, archived: true, data: rootBytes(t, initial), ok: true},
+		{name: "rotated", pins: []string{key.ID()}, archived: true, data: rootBytes(t, rotated), ok: true},
+		{name: "forged", pins: []string{key.ID()}, archived: true, data: rootBytes(t, forged)},
+		{name: "not archived", pins: []string{key.ID()}, data: rootBytes(t, rotated)},
+		{name: "initial not pinned", pins: []string{nextKey.ID()}, archived: true, data: rootBytes(t, rotated)},
+		{name: "no pins", data: rootBytes(t, rotated), ok: true},
+		{name: "not self-signed", data: rootBytes(t, metadata.Root())},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{InstallDir: t.TempDir(), RootKeyIDs: tt.pins}
+			if tt.archived {
+				if err := archiveRoot(cfg, rootBytes(t, initial)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := verifyTrustedRoot(cfg, tt.data)
+			if tt.ok && err != nil {
+				t.Fatalf("verifyTrustedRoot() = %v, want nil", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrUntrustedRoot) {
+				t.Fatalf("verifyTrustedRoot() = %v, want %v", err, ErrUntrustedRoot)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package updater
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// channelRegex matches the names of the release channels, e.g. stable, beta or canary.
+var channelRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// Link is a symlink that is pointed to a file of the active version of a service.
+type Link struct {
+	// Name is the absolute path of the symlink.
+	Name string `yaml:"name"`
+	// Target is the path of the linked file relative to the version folder.
+	Target string `yaml:"target"`
+}
+
+// ServiceConfig holds the configuration of one of the services kept updated.
+// The first link is the one used to find out which version is running.
+type ServiceConfig struct {
+	Name string `yaml:"name"`
+	Unit string `yaml:"unit"`
+	// Channel is the release channel the service follows (default --channel).
+	Channel string `yaml:"channel"`
+	// Channels maps release channels to the target path of their index, overriding
+	// the default <name>/<name>-index.json for stable and <name>/<channel>/<name>-index.json
+	// for the other channels.
+	Channels   map[string]string `yaml:"channels"`
+	Index      string            `yaml:"index"`
+	InstallDir string            `yaml:"install-dir"`
+	StatusFile string            `yaml:"status-file"`
+	HealthURL  string            `yaml:"health-url"`
+	// ArtifactTarget is the TUF target path of the artifact, where {version} stands for
+	// the version of the index. When empty the artifact is fetched from the index path.
+	ArtifactTarget string `yaml:"artifact-target"`
+	// Pinned versions are never deleted by the retention policy.
+	Pinned []string `yaml:"pinned"`
+	Links  []Link   `yaml:"links"`
+
+	targetsDir  string
+	downloadDir string
+}
+
+// servicesFile is the content of the file given by --services-file.
+type servicesFile struct {
+	Services []ServiceConfig `yaml:"services"`
+}
+
+// LoadServices returns the services to update. When no services file is configured
+// the only service is the one given by the --service flags.
+func (c *Config) LoadServices() ([]*ServiceConfig, error) {
+	var services []*ServiceConfig
+	if c.ServicesFile == "" {
+		services = append(services, &ServiceConfig{
+			Name:           c.Service,
+			Unit:           c.UnitName,
+			InstallDir:     c.InstallDir,
+			StatusFile:     c.StatusFile,
+			HealthURL:      c.HealthURL,
+			ArtifactTarget: c.ArtifactTarget,
+			Pinned:         c.PinnedVersions,
+			Links: []Link{
+				{Name: c.ServiceLink, Target: path.Join("bin", c.Service)},
+				{Name: c.ConfigLink, Target: path.Join("config", filepath.Base(c.ConfigLink))},
+			},
+		})
+	} else {
+		content, err := os.ReadFile(c.ServicesFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read services file: %w", err)
+		}
+		var file servicesFile
+		if err := yaml.Unmarshal(content, &file); err != nil {
+			return nil, fmt.Errorf("failed to parse services file %s: %w", c.ServicesFile, err)
+		}
+		if len(file.Services) == 0 {
+			return nil, fmt.Errorf("invalid services file %s: no services declared", c.ServicesFile)
+		}
+		for i := range file.Services {
+			services = append(services, &file.Services[i])
+		}
+	}
+
+	for _, svc := range services {
+		svc.setDefaults(c)
+	}
+	if err := validateServices(services); err != nil {
+		return nil, fmt.Errorf("invalid services: %w", err)
+	}
+	return services, nil
+}
+
+func (s *ServiceConfig) setDefaults(c *Config) {
+	if s.Unit == "" {
+		s.Unit = s.Name + ".service"
+	}
+	if s.Channel == "" {
+		s.Channel = c.Channel
+	}
+	if s.Index == "" {
+		s.Index = s.channelIndex()
+	}
+	if s.InstallDir == "" {
+		s.InstallDir = filepath.Join(c.InstallDir, s.Name)
+	}
+	if s.StatusFile == "" {
+		s.StatusFile = filepath.Join(s.InstallDir, "update_status.json")
+	}
+	s.targetsDir = c.TargetsDir()
+	s.downloadDir = c.StagingDir()
+}
+
+// validateServices checks every service and that services do not share any path.
+func validateServices(services []*ServiceConfig) error {
+	var errs []error
+	seen := map[string]string{}
+	unique := func(kind, value, service string) {
+		key := kind + ":" + value
+		if other, ok := seen[key]; ok {
+			errs = append(errs, fmt.Errorf("services %s and %s share the %s %s", other, service, kind, value))
+			return
+		}
+		seen[key] = service
+	}
+
+	for _, s := range services {
+		if s.Name == "" || s.Name != filepath.Base(s.Name) {
+			errs = append(errs, fmt.Errorf("invalid service name %q: must be a plain name", s.Name))
+			continue
+		}
+		if !filepath.IsAbs(s.InstallDir) {
+			errs = append(errs, fmt.Errorf("invalid install-dir %q of %s: must be an absolute path", s.InstallDir, s.Name))
+		}
+		if !filepath.IsAbs(s.StatusFile) {
+			errs = append(errs, fmt.Errorf("invalid status-file %q of %s: must be an absolute path", s.StatusFile, s.Name))
+		}
+		if !channelRegex.MatchString(s.Channel) {
+			errs = append(errs, fmt.Errorf("invalid channel %q of %s: must be a lowercase name", s.Channel, s.Name))
+		}
+		if s.HealthURL != "" {
+			if err := validateURL(s.HealthURL); err != nil {
+				errs = append(errs, fmt.Errorf("invalid health-url %q of %s: %w", s.HealthURL, s.Name, err))
+			}
+		}
+		if s.ArtifactTarget != "" && !filepath.IsLocal(s.ArtifactTarget) {
+			errs = append(errs, fmt.Errorf("invalid artifact-target %q of %s: must be a relative target path", s.ArtifactTarget, s.Name))
+		}
+		if len(s.Links) == 0 {
+			errs = append(errs, fmt.Errorf("service %s has no links", s.Name))
+		}
+		for _, l := range s.Links {
+			if !filepath.IsAbs(l.Name) {
+				errs = append(errs, fmt.Errorf("invalid link %q of %s: must be an absolute path", l.Name, s.Name))
+			}
+			if l.Target == "" || filepath.IsAbs(l.Target) || !filepath.IsLocal(l.Target) {
+				errs = append(errs, fmt.Errorf("invalid link target %q of %s: must be relative to the version folder", l.Target, s.Name))
+			}
+			unique("link", l.Name, s.Name)
+		}
+		unique("name", s.Name, s.Name)
+		unique("unit", s.Unit, s.Name)
+		unique("index", s.Index, s.Name)
+		unique("install-dir", s.InstallDir, s.Name)
+		unique("status-file", s.StatusFile, s.Name)
+	}
+	return errors.Join(errs...)
+}
+
+// IndexFile returns the location of the service index target.
+func (s *ServiceConfig) IndexFile() string {
+	return filepath.Join(s.targetsDir, filepath.FromSlash(s.Index))
+}
+
+// channelIndex returns the target path of the index of the channel of the service. Each
+// channel has its own path, so a channel can be published by its own delegated role,
+// trusted for the paths of the channel only.
+func (s *ServiceConfig) channelIndex() string {
+	if index, ok := s.Channels[s.Channel]; ok {
+		return index
+	}
+	if s.Channel == DefaultChannel {
+		return path.Join(s.Name, fmt.Sprintf("%s-index.json", s.Name))
+	}
+	return path.Join(s.Name, s.Channel, fmt.Sprintf("%s-index.json", s.Name))
+}
+
+// artifactTargetPath returns the TUF target path of the artifact of the given version.
+func (s *ServiceConfig) artifactTargetPath(version string) string {
+	return strings.ReplaceAll(s.ArtifactTarget, "{version}", version)
+}
+
+// DownloadPath returns where the artifact with the given SHA256 is staged while it is
+// downloaded and until its hash is verified.
+func (s *ServiceConfig) DownloadPath(sha256 string) string {
+	return filepath.Join(s.downloadDir, fmt.Sprintf("%s-%s.zip.part", s.Name, sha256))
+}
+
+// ArchivePath returns where a verified artifact is kept before being unzipped.
+func (s *ServiceConfig) ArchivePath() string {
+	return filepath.Join(s.InstallDir, s.Name+".zip")
+}
+
+// HistoryFile returns the file where the outcome of every update of the service is recorded.
+func (s *ServiceConfig) HistoryFile() string {
+	return filepath.Join(s.InstallDir, "update_history.jsonl")
+}
+
+// VersionDir returns the directory where the given version is installed.
+func (s *ServiceConfig) VersionDir(version string) string {
+	return filepath.Join(s.InstallDir, version)
+}
+
+// partialVersionDir returns the directory where the given version is unzipped before being
+// renamed to its version folder. It is hidden from the listing of the installed versions.
+func (s *ServiceConfig) partialVersionDir(version string) string {
+	return filepath.Join(s.InstallDir, "."+version+".part")
+}
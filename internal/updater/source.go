@@ -0,0 +1,148 @@
+package updater
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/oauth2/google"
+)
+
+// ArtifactSource is a storage backend artifacts are downloaded from. Every backend feeds
+// the same staging and verification: a source is never trusted, the artifact is checked
+// against the signed length and hashes.
+type ArtifactSource interface {
+	// Open opens the artifact at location for reading from offset. It returns the offset
+	// the reader actually starts at, which is 0 when the backend cannot resume.
+	Open(ctx context.Context, location *url.URL, offset int64) (io.ReadCloser, int64, error)
+}
+
+// ErrUnsupportedSource is returned when no backend handles the location of an artifact.
+var ErrUnsupportedSource = errors.New("unsupported artifact location")
+
+// Hosts of Google Artifact Registry, whose https locations are downloaded with the service account.
+var garHosts = []string{"artifactregistry.googleapis.com", ".pkg.dev"}
+
+// artifactSource returns the backend for the location of an artifact, chosen by its scheme:
+//   - gar:// and the https locations of Google Artifact Registry use the service account;
+//   - https:// and http:// are downloaded without authentication;
+//   - file:// reads a local file;
+//   - s3://bucket/key reads from an S3-compatible object store;
+//   - oci://registry/repository:tag or @digest reads the layer of an OCI artifact.
+func (c *Config) artifactSource(location string) (ArtifactSource, *url.URL, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid artifact location %q: %w", location, err)
+	}
+
+	switch u.Scheme {
+	case "gar":
+		https := *u
+		https.Scheme = "https"
+		return &garSource{keyPath: c.ServiceAccountKeyPath}, &https, nil
+	case "https":
+		for _, host := range garHosts {
+			if u.Host == host || (strings.HasPrefix(host, ".") && strings.HasSuffix(u.Host, host)) {
+				return &garSource{keyPath: c.ServiceAccountKeyPath}, u, nil
+			}
+		}
+		return httpSource{}, u, nil
+	case "http":
+		return httpSource{}, u, nil
+	case "file":
+		return fileSource{}, u, nil
+	case "s3":
+		return &s3Source{
+			endpoint:  c.S3Endpoint,
+			region:    c.S3Region,
+			accessKey: c.S3AccessKey,
+			secretKey: c.S3SecretKey,
+		}, u, nil
+	case "oci":
+		return &ociSource{username: c.OCIUsername, password: c.OCIPassword}, u, nil
+	default:
+		return nil, nil, fmt.Errorf("%w: %q", ErrUnsupportedSource, location)
+	}
+}
+
+// artifactOpener returns how to open the artifact at location with its backend.
+func (c *Config) artifactOpener(location string) (openFunc, error) {
+	src, u, err := c.artifactSource(location)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, offset int64) (io.ReadCloser, int64, error) {
+		return src.Open(ctx, u, offset)
+	}, nil
+}
+
+// garSource downloads from Google Artifact Registry using a Google service account.
+type garSource struct {
+	keyPath string
+}
+
+func (s *garSource) Open(ctx context.Context, location *url.URL, offset int64) (io.ReadCloser, int64, error) {
+	if s.keyPath == "" {
+		return nil, 0, errors.New("service-account-key is not configured")
+	}
+	key, err := os.ReadFile(s.keyPath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read service account key: %w", err)
+	}
+
+	// Authenticate using the service account key
+	creds, err := google.CredentialsFromJSON(ctx, key, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to load service account credentials: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location.String(), nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// Add Authorization header with Bearer token
+	token, err := creds.TokenSource.Token()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to retrieve token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	return doRangeRequest(req, offset)
+}
+
+// httpSource downloads over HTTP without authentication.
+type httpSource struct{}
+
+func (httpSource) Open(ctx context.Context, location *url.URL, offset int64) (io.ReadCloser, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location.String(), nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	return doRangeRequest(req, offset)
+}
+
+// fileSource reads local files.
+type fileSource struct{}
+
+func (fileSource) Open(ctx context.Context, location *url.URL, offset int64) (io.ReadCloser, int64, error) {
+	if location.Host != "" && location.Host != "localhost" {
+		return nil, 0, fmt.Errorf("%w: file location on host %q", ErrUnsupportedSource, location.Host)
+	}
+	return fileOpener(location.Path)(ctx, offset)
+}
+
+// httpOpener opens the artifact at url without authentication, resuming with an HTTP Range request.
+func httpOpener(rawURL string) openFunc {
+	return func(ctx context.Context, offset int64) (io.ReadCloser, int64, error) {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, 0, err
+		}
+		return httpSource{}.Open(ctx, u, offset)
+	}
+}
@@ -0,0 +1,288 @@
+package updater
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ociSource downloads the artifact stored as a layer of an OCI artifact,
+// oci://registry/repository:tag or oci://registry/repository@digest, through the
+// OCI distribution API. The layer is the one whose title ends in .zip, or the only one.
+// A reference to an index is followed to its manifest when it lists a single one.
+type ociSource struct {
+	username string
+	password string
+}
+
+const ociTitleAnnotation = "org.opencontainers.image.title"
+
+// Media types of the OCI and Docker manifests and of the indexes listing them.
+const (
+	ociManifestMediaType    = "application/vnd.oci.image.manifest.v1+json"
+	ociIndexMediaType       = "application/vnd.oci.image.index.v1+json"
+	dockerManifestMediaType = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerListMediaType     = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// ociManifest is the part of an OCI image manifest used to find the artifact layer, or of
+// an index used to find its manifest.
+type ociManifest struct {
+	MediaType string `json:"mediaType"`
+	Layers    []struct {
+		MediaType   string            `json:"mediaType"`
+		Digest      string            `json:"digest"`
+		Size        int64             `json:"size"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"layers"`
+	Manifests []struct {
+		MediaType string `json:"mediaType"`
+		Digest    string `json:"digest"`
+	} `json:"manifests"`
+}
+
+func (s *ociSource) Open(ctx context.Context, location *url.URL, offset int64) (io.ReadCloser, int64, error) {
+	registry := location.Host
+	repository, reference := parseOCIReference(strings.TrimPrefix(location.Path, "/"))
+	if registry == "" || repository == "" {
+		return nil, 0, fmt.Errorf("invalid OCI location %q: must be oci://registry/repository:tag", location)
+	}
+	base := "https://" + registry + "/v2/" + repository
+
+	manifest, index, err := s.manifest(ctx, base, reference)
+	if err != nil {
+		return nil, 0, err
+	}
+	if index {
+		// An artifact has no platform variants to pick from, so only an index of one manifest is followed
+		if len(manifest.Manifests) != 1 {
+			return nil, 0, fmt.Errorf("%s is an index of %d manifests, reference the artifact manifest by digest", location, len(manifest.Manifests))
+		}
+		if manifest, index, err = s.manifest(ctx, base, manifest.Manifests[0].Digest); err != nil {
+			return nil, 0, err
+		}
+		if index {
+			return nil, 0, fmt.Errorf("%s is an index of indexes, reference the artifact manifest by digest", location)
+		}
+	}
+
+	digest := ""
+	for _, layer := range manifest.Layers {
+		if strings.HasSuffix(layer.Annotations[ociTitleAnnotation], ".zip") {
+			digest = layer.Digest
+			break
+		}
+	}
+	if digest == "" && len(manifest.Layers) == 1 {
+		digest = manifest.Layers[0].Digest
+	}
+	if digest == "" {
+		return nil, 0, fmt.Errorf("no artifact layer found in %s", location)
+	}
+
+	blob, err := s.get(ctx, base+"/blobs/"+digest, offset, "")
+	if err != nil {
+		return nil, 0, err
+	}
+	switch {
+	case blob.StatusCode == http.StatusPartialContent && offset > 0:
+		return blob.Body, offset, nil
+	case blob.StatusCode == http.StatusOK:
+		return blob.Body, 0, nil
+	default:
+		blob.Body.Close()
+		return nil, 0, fmt.Errorf("failed to download the OCI blob, status code: %d", blob.StatusCode)
+	}
+}
+
+// manifest gets the manifest of reference, a tag or a digest, and reports whether it is
+// an index or a manifest list rather than a manifest.
+func (s *ociSource) manifest(ctx context.Context, base, reference string) (*ociManifest, bool, error) {
+	accept := strings.Join([]string{ociManifestMediaType, dockerManifestMediaType, ociIndexMediaType, dockerListMediaType}, ", ")
+	resp, err := s.get(ctx, base+"/manifests/"+reference, 0, accept)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("failed to get the OCI manifest, status code: %d", resp.StatusCode)
+	}
+	var manifest ociManifest
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&manifest); err != nil {
+		return nil, false, fmt.Errorf("failed to parse the OCI manifest: %w", err)
+	}
+
+	// The media type is optional in the body, the registry always sends it as the content type
+	mediaType := manifest.MediaType
+	if mediaType == "" {
+		mediaType, _, _ = strings.Cut(resp.Header.Get("Content-Type"), ";")
+	}
+	switch strings.TrimSpace(mediaType) {
+	case ociIndexMediaType, dockerListMediaType:
+		return &manifest, true, nil
+	case ociManifestMediaType, dockerManifestMediaType:
+		return &manifest, false, nil
+	default:
+		if len(manifest.Manifests) > 0 {
+			return &manifest, true, nil
+		}
+		return &manifest, false, nil
+	}
+}
+
+// parseOCIReference splits repository:tag or repository@digest. The tag defaults to latest.
+func parseOCIReference(ref string) (string, string) {
+	if repository, digest, ok := strings.Cut(ref, "@"); ok {
+		return repository, digest
+	}
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, "latest"
+}
+
+// get sends a GET request to the registry. When the registry asks for a bearer token,
+// one is requested to its token service, with the configured credentials if any.
+func (s *ociSource) get(ctx context.Context, rawURL string, offset int64, accept string) (*http.Response, error) {
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		return req, nil
+	}
+
+	req, err := newRequest()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+
+	token, err := s.token(ctx, challenge)
+	if err != nil {
+		return nil, err
+	}
+	if req, err = newRequest(); err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+	return resp, nil
+}
+
+// token requests a bearer token for the given WWW-Authenticate challenge.
+func (s *ociSource) token(ctx context.Context, challenge string) (string, error) {
+	scheme, params, err := parseChallenge(challenge)
+	if err != nil {
+		return "", err
+	}
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", fmt.Errorf("unsupported registry authentication %q", scheme)
+	}
+	realm := params["realm"]
+	if realm == "" {
+		return "", errors.New("registry authentication challenge has no realm")
+	}
+	// The realm may already have a query, e.g. the account of the token service
+	tokenURL, err := url.Parse(realm)
+	if err != nil {
+		return "", fmt.Errorf("invalid registry authentication realm %q: %w", realm, err)
+	}
+	query := tokenURL.Query()
+	for key, value := range params {
+		if key != "realm" {
+			query.Set(key, value)
+		}
+	}
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create token request: %w", err)
+	}
+	if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request a registry token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to request a registry token, status code: %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to parse the registry token: %w", err)
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	return body.AccessToken, nil
+}
+
+// parseChallenge parses a WWW-Authenticate challenge, <scheme> <key>=<value>, ..., into its scheme
+// and parameters. Values are tokens or quoted strings, which may contain commas and escaped
+// characters, e.g. scope="repository:app:pull,push".
+func parseChallenge(challenge string) (string, map[string]string, error) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	params := map[string]string{}
+	for {
+		rest = strings.TrimLeft(rest, " \t,")
+		if rest == "" {
+			return scheme, params, nil
+		}
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			return "", nil, fmt.Errorf("invalid registry authentication challenge %q", challenge)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimLeft(value, " \t")
+
+		if !strings.HasPrefix(value, `"`) {
+			token, next, _ := strings.Cut(value, ",")
+			params[key] = strings.TrimSpace(token)
+			rest = next
+			continue
+		}
+		var b strings.Builder
+		i := 1
+		for ; i < len(value) && value[i] != '"'; i++ {
+			if value[i] == '\\' && i+1 < len(value) {
+				i++
+			}
+			b.WriteByte(value[i])
+		}
+		if i == len(value) {
+			return "", nil, fmt.Errorf("invalid registry authentication challenge %q: unterminated quoted value", challenge)
+		}
+		params[key] = b.String()
+		rest = value[i+1:]
+	}
+}
@@ -0,0 +1,259 @@
+package updater
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testAccessKey = "AKIDEXAMPLE"
+	testSecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+)
+
+var testArtifact = []byte("PK artifact content")
+
+// openAll opens location from offset and reads it whole.
+func openAll(t *testing.T, src ArtifactSource, location string, offset int64) ([]byte, int64, error) {
+	t.Helper()
+	u, err := url.Parse(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, start, err := src.Open(context.Background(), u, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, start, nil
+}
+
+func TestS3Sign(t *testing.T) {
+	s := &s3Source{region: "us-east-1", accessKey: testAccessKey, secretKey: testSecretKey}
+	req := httptest.NewRequest(http.MethodGet, "https://s3.example.com/bucket/dir/my%20file.zip", nil)
+	s.sign(req, "/bucket/dir/my%20file.zip", time.Date(2025, 3, 14, 12, 0, 0, 0, time.UTC))
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20250314/us-east-1/s3/aws4_request, " +
+		"SignedHeaders=host;x-amz-content-sha256;x-amz-date, " +
+		"Signature=ec4af0de06eda4c17cd4eac4ac489a6f97901466573b74136765f6ffb6b8f8fe"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Fatalf("Authorization = %q, want %q", got, want)
+	}
+	if got := req.Header.Get("x-amz-date"); got != "20250314T120000Z" {
+		t.Fatalf("x-amz-date = %q", got)
+	}
+	if got := req.Header.Get("x-amz-content-sha256"); got != s3UnsignedPayload {
+		t.Fatalf("x-amz-content-sha256 = %q", got)
+	}
+}
+
+func TestS3Open(t *testing.T) {
+	signer := &s3Source{region: "eu-west-1", accessKey: testAccessKey, secretKey: testSecretKey}
+	var ignoreRange bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() != "/store/bucket/dir/my%20file.zip" {
+			http.NotFound(w, r)
+			return
+		}
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			// Sign the request again as received, with the secret of the server
+			date, err := time.Parse("20060102T150405Z", r.Header.Get("x-amz-date"))
+			if err != nil {
+				http.Error(w, "invalid date", http.StatusForbidden)
+				return
+			}
+			check := r.Clone(r.Context())
+			check.URL.Host = r.Host
+			signer.sign(check, r.URL.EscapedPath(), date)
+			if check.Header.Get("Authorization") != auth {
+				http.Error(w, "signature mismatch", http.StatusForbidden)
+				return
+			}
+		}
+		// Anonymous requests are accepted, as for a public bucket
+		if ignoreRange {
+			r.Header.Del("Range")
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(testArtifact))
+	}))
+	defer srv.Close()
+
+	location := "s3://bucket/dir/my file.zip"
+	signed := &s3Source{endpoint: srv.URL + "/store", region: "eu-west-1", accessKey: testAccessKey, secretKey: testSecretKey}
+
+	data, start, err := openAll(t, signed, location, 0)
+	if err != nil || start != 0 || !bytes.Equal(data, testArtifact) {
+		t.Fatalf("Open() = %q, %d, %v", data, start, err)
+	}
+
+	// A partial download is resumed with a Range request
+	data, start, err = openAll(t, signed, location, 3)
+	if err != nil || start != 3 || !bytes.Equal(data, testArtifact[3:]) {
+		t.Fatalf("Open(3) = %q, %d, %v", data, start, err)
+	}
+
+	// A server ignoring the range sends the whole artifact again
+	ignoreRange = true
+	data, start, err = openAll(t, signed, location, 3)
+	if err != nil || start != 0 || !bytes.Equal(data, testArtifact) {
+		t.Fatalf("Open(3) without range support = %q, %d, %v", data, start, err)
+	}
+	ignoreRange = false
+
+	anonymous := &s3Source{endpoint: srv.URL + "/store", region: "eu-west-1"}
+	if _, _, err := openAll(t, anonymous, location, 0); err != nil {
+		t.Fatalf("anonymous Open() = %v", err)
+	}
+
+	wrongKey := &s3Source{endpoint: srv.URL + "/store", region: "eu-west-1", accessKey: testAccessKey, secretKey: "wrong"}
+	if _, _, err := openAll(t, wrongKey, location, 0); err == nil {
+		t.Fatal("Open() with a wrong secret key succeeded")
+	}
+	noSecret := &s3Source{endpoint: srv.URL + "/store", region: "eu-west-1", accessKey: testAccessKey}
+	if _, _, err := openAll(t, noSecret, location, 0); err == nil {
+		t.Fatal("Open() without secret key succeeded")
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	tests := []struct {
+		challenge string
+		scheme    string
+		params    map[string]string
+		ok        bool
+	}{
+		{
+			challenge: `Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:team/app:pull,push"`,
+			scheme:    "Bearer",
+			params:    map[string]string{"realm": "https://auth.example.com/token", "service": "registry.example.com", "scope": "repository:team/app:pull,push"},
+			ok:        true,
+		},
+		{
+			challenge: `Bearer realm="https://auth.example.com/token", scope="a,b" , error=invalid_token`,
+			scheme:    "Bearer",
+			params:    map[string]string{"realm": "https://auth.example.com/token", "scope": "a,b", "error": "invalid_token"},
+			ok:        true,
+		},
+		{
+			challenge: `Bearer realm="https://auth.example.com/token",service="say \"hi\""`,
+			scheme:    "Bearer",
+			params:    map[string]string{"realm": "https://auth.example.com/token", "service": `say "hi"`},
+			ok:        true,
+		},
+		{challenge: `Basic realm="registry"`, scheme: "Basic", params: map[string]string{"realm": "registry"}, ok: true},
+		{challenge: `Bearer realm="https://auth.example.com/token`},
+		{challenge: `Bearer realm`},
+	}
+	for _, tt := range tests {
+		scheme, params, err := parseChallenge(tt.challenge)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("parseChallenge(%q) accepted an invalid challenge", tt.challenge)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseChallenge(%q) = %v", tt.challenge, err)
+			continue
+		}
+		if scheme != tt.scheme || fmt.Sprint(params) != fmt.Sprint(tt.params) {
+			t.Errorf("parseChallenge(%q) = %q, %v, want %q, %v", tt.challenge, scheme, params, tt.scheme, tt.params)
+		}
+	}
+}
+
+func TestOCIOpen(t *testing.T) {
+	const (
+		token  = "registry-token"
+		scope  = "repository:team/app:pull,push"
+		digest = "sha256:0123456789abcdef"
+	)
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			user, password, ok := r.BasicAuth()
+			if !ok || user != "reader" || password != "secret" {
+				http.Error(w, "bad credentials", http.StatusUnauthorized)
+				return
+			}
+			query := r.URL.Query()
+			if query.Get("scope") != scope || query.Get("service") != "registry.test" || query.Get("account") != "reader" {
+				http.Error(w, "bad scope", http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"token": token})
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token?account=reader",service="registry.test",scope="%s"`, srv.URL, scope))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/team/app/manifests/index":
+			w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+			fmt.Fprint(w, `{"manifests": [{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:abcdef"}]}`)
+		case "/v2/team/app/manifests/multi":
+			w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.list.v2+json")
+			fmt.Fprint(w, `{"manifests": [
+				{"mediaType": "application/vnd.docker.distribution.manifest.v2+json", "digest": "sha256:abcdef"},
+				{"mediaType": "application/vnd.docker.distribution.manifest.v2+json", "digest": "sha256:bcdefa"}
+			]}`)
+		case "/v2/team/app/manifests/1.0", "/v2/team/app/manifests/sha256:abcdef":
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			fmt.Fprintf(w, `{"layers": [
+				{"mediaType": "application/octet-stream", "digest": "sha256:fedcba", "annotations": {%q: "README.md"}},
+				{"mediaType": "application/zip", "digest": %q, "annotations": {%q: "app.zip"}}
+			]}`, ociTitleAnnotation, digest, ociTitleAnnotation)
+		case "/v2/team/app/blobs/" + digest:
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(testArtifact))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	// The registry is always reached over https
+	defaultClient := http.DefaultClient
+	http.DefaultClient = srv.Client()
+	defer func() { http.DefaultClient = defaultClient }()
+
+	host := strings.TrimPrefix(srv.URL, "https://")
+	src := &ociSource{username: "reader", password: "secret"}
+
+	data, start, err := openAll(t, src, "oci://"+host+"/team/app:1.0", 0)
+	if err != nil || start != 0 || !bytes.Equal(data, testArtifact) {
+		t.Fatalf("Open() = %q, %d, %v", data, start, err)
+	}
+	data, start, err = openAll(t, src, "oci://"+host+"/team/app:1.0", 5)
+	if err != nil || start != 5 || !bytes.Equal(data, testArtifact[5:]) {
+		t.Fatalf("Open(5) = %q, %d, %v", data, start, err)
+	}
+
+	data, _, err = openAll(t, src, "oci://"+host+"/team/app:index", 0)
+	if err != nil || !bytes.Equal(data, testArtifact) {
+		t.Fatalf("Open() of an index = %q, %v", data, err)
+	}
+	if _, _, err := openAll(t, src, "oci://"+host+"/team/app:multi", 0); err == nil || !strings.Contains(err.Error(), "index of 2 manifests") {
+		t.Fatalf("Open() of a manifest list = %v, want an index error", err)
+	}
+
+	if _, _, err := openAll(t, &ociSource{username: "reader", password: "wrong"}, "oci://"+host+"/team/app:1.0", 0); err == nil {
+		t.Fatal("Open() with wrong credentials succeeded")
+	}
+	if _, _, err := openAll(t, src, "oci://"+host+"/team/app:2.0", 0); err == nil {
+		t.Fatal("Open() of a missing tag succeeded")
+	}
+}
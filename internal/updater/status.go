@@ -0,0 +1,94 @@
+package updater
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// UpdateStatus is the content of the status file shared with the server.
+// ScheduledFor is set while a requested update waits for the next maintenance window,
+// and AutomaticUpdate when the update was requested by the auto-update mode. RejectedVersion
+// is the version an operator rolled back from, not installed automatically again.
+type UpdateStatus struct {
+	UpdateAvailable int    `json:"update_available"`
+	UpdateRequested int    `json:"update_requested"`
+	AutomaticUpdate int    `json:"automatic_update,omitempty"`
+	ScheduledFor    string `json:"scheduled_for,omitempty"`
+	RejectedVersion string `json:"rejected_version,omitempty"`
+}
+
+// statusMu serializes the changes of the status files made by the check and apply loops.
+var statusMu sync.Mutex
+
+// LockStatusFile takes the lock serializing the changes of statusFile across processes,
+// held by the updater and the server while they read and rewrite it. The lock file sits
+// next to the status file.
+func LockStatusFile(statusFile string) (func(), error) {
+	return lockFile(filepath.Join(filepath.Dir(statusFile), "."+filepath.Base(statusFile)+".lock"))
+}
+
+// readUpdateStatus reads the status file. A missing file is an empty status.
+func readUpdateStatus(statusFile string) (UpdateStatus, error) {
+	var status UpdateStatus
+	fileContent, err := os.ReadFile(statusFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return status, nil
+	}
+	if err != nil {
+		return status, fmt.Errorf("failed to read JSON file: %w", err)
+	}
+	if err := json.Unmarshal(fileContent, &status); err != nil {
+		return status, fmt.Errorf("error parsing JSON: %w", err)
+	}
+	return status, nil
+}
+
+// updateStatusFile applies change to the status file, keeping the fields it does not touch
+// so that a pending update request is not lost when the availability changes.
+func updateStatusFile(statusFile string, change func(*UpdateStatus)) error {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	unlock, err := LockStatusFile(statusFile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	status, err := readUpdateStatus(statusFile)
+	if err != nil {
+		// Rewrite a corrupted status file from scratch
+		status = UpdateStatus{}
+	}
+	change(&status)
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(statusFile, data, 0644); err != nil {
+		return err
+	}
+	publishFile(statusFile)
+	publishStatus()
+	return nil
+}
+
+// setUpdateStatus writes update_available to the status file.
+func setUpdateStatus(statusFile string, value int) error {
+	return updateStatusFile(statusFile, func(s *UpdateStatus) {
+		s.UpdateAvailable = value
+	})
+}
+
+// ReadUpdateRequested extracts the "update_requested" value from the status file.
+func ReadUpdateRequested(statusFile string) (int, error) {
+	status, err := readUpdateStatus(statusFile)
+	if err != nil {
+		return 0, err
+	}
+	return status.UpdateRequested, nil
+}
@@ -1,178 +1,917 @@
 package updater
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	stdlog "log"
 
 	"github.com/go-logr/stdr"
 	"github.com/theupdateframework/go-tuf/v2/metadata"
-	"github.com/theupdateframework/go-tuf/v2/metadata/config"
-	"github.com/theupdateframework/go-tuf/v2/metadata/updater"
+	"github.com/theupdateframework/go-tuf/v2/metadata/fetcher"
 )
 
+// Phase identifies a step of the update pipeline.
+type Phase string
+
 const (
-	metadataURL          = "https://sorayaormazabalmayo.github.io/TUF_Repository_YubiKey_Vault/metadata"
-	targetsURL           = "https://sorayaormazabalmayo.github.io/TUF_Repository_YubiKey_Vault/targets"
-	verbosity            = 0
-	generateRandomFolder = false
+	PhaseCheck    Phase = "check"
+	PhaseDownload Phase = "download"
+	PhaseVerify   Phase = "verify"
+	PhaseInstall  Phase = "install"
+	PhaseActivate Phase = "activate"
+	PhaseHealth   Phase = "health"
 )
 
 var (
-	services   = []string{"general-service"}
-	jsonPath   = "update_status.json"
-	checkDelay = 60 * time.Second
+	// ErrNoUpdate is returned when there is no new release to apply.
+	ErrNoUpdate = errors.New("no update available")
+	// ErrHashMismatch is returned when the downloaded artifact does not match its index.
+	ErrHashMismatch = errors.New("artifact hash does not match the index")
+	// ErrOutOfOrder is returned when a phase is run before the phase it depends on.
+	ErrOutOfOrder = errors.New("phase run before the previous one")
 )
 
-type UpdateStatus struct {
-	UpdateAvailable int `json:"update_available"`
+// Error is returned by the Updater phases. It records in which phase and
+// for which service the update failed.
+type Error struct {
+	Phase   Phase
+	Service string
+	Err     error
 }
 
-// Run executes the updater logic.
-func Run() error {
-	// Set up logging.
-	metadata.SetLogger(stdr.New(stdlog.New(os.Stdout, "updater: ", stdlog.LstdFlags)))
-	stdr.SetVerbosity(verbosity)
-	log := metadata.GetLogger()
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Phase, e.Service, e.Err)
+}
 
-	metadataDir, err := InitEnvironment()
-	if err != nil {
-		log.Error(err, "Failed to initialize environment")
-		return err
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// CheckResult is the result of Check.
+type CheckResult struct {
+	Service          string
+	CurrentVersion   string
+	Index            IndexInfo
+	UpdateAvailable  bool
+	NewIndexDownload bool
+	// Downgrade is set when the indexed release is older than the installed one.
+	Downgrade bool
+	// RolloutDeferred is set when the release is newer but not yet rolled out to this machine.
+	RolloutDeferred bool
+}
+
+// DownloadResult is the result of Download.
+type DownloadResult struct {
+	Path string
+
+	index IndexInfo
+	hash  string
+	// target is set for the artifacts published as TUF targets.
+	target *ArtifactTarget
+}
+
+// VerifyResult is the result of Verify.
+type VerifyResult struct {
+	Path    string
+	SHA256  string
+	Version string
+}
+
+// InstallResult is the result of Install.
+type InstallResult struct {
+	Version string
+	Dir     string
+
+	// retained is set when the version was already on disk, so it is kept if activating it fails.
+	retained bool
+}
+
+// ActivateResult is the result of Activate.
+type ActivateResult struct {
+	Version         string
+	PreviousVersion string
+	Removed         []string
+}
+
+// Updater checks, downloads, verifies, installs and activates the releases of a service.
+// The phases must be run in order: each one takes the result of the previous one, so that
+// a check running meanwhile does not change the release being applied.
+type Updater struct {
+	cfg         *Config
+	svc         *ServiceConfig
+	log         metadata.Logger
+	metadataDir string
+	bundle      *Bundle
+	fetcher     fetcher.Fetcher
+
+	allowDowngrade bool
+
+	mu         sync.Mutex
+	autoFailed string
+
+	// Control state, guarded by ctlMu: the running Apply and the last check.
+	ctlMu       sync.Mutex
+	applying    bool
+	phase       Phase
+	release     string
+	cancel      context.CancelFunc
+	canceled    bool
+	progress    *Progress
+	progressAt  time.Time
+	lastCheck   time.Time
+	lastSuccess time.Time
+	lastResult  *CheckResult
+	lastErr     error
+	lastErrAt   time.Time
+}
+
+// Option configures an Updater.
+type Option func(*Updater)
+
+// WithBundle makes the Updater read the TUF metadata and the artifact from an offline
+// bundle instead of the remote repository. They are verified the same way.
+func WithBundle(b *Bundle) Option {
+	return func(u *Updater) {
+		u.bundle = b
+		u.fetcher = b.fetcher(u.cfg)
 	}
+}
 
-	if err = InitTrustOnFirstUse(metadataDir); err != nil {
-		log.Error(err, "Trust-On-First-Use failed")
-		return err
+// AllowDowngrade lets the Updater install a release older than the installed one,
+// for an explicitly requested rollback. Otherwise older releases are refused.
+func AllowDowngrade() Option {
+	return func(u *Updater) {
+		u.allowDowngrade = true
 	}
+}
 
-	// Check for updates in a loop.
-	for {
-		for _, service := range services {
-			_, found, err := DownloadTargetIndex(metadataDir, service)
-			if err != nil {
-				log.Error(err, "Failed to download target index")
-			}
-			if found == 0 {
-				if err := setUpdateStatus(1); err != nil {
-					fmt.Println("Error updating update_status.json:", err)
-				} else {
-					fmt.Println("Update available flag set in update_status.json")
-				}
-			} else {
-				fmt.Println("Local index is up-to-date.")
-			}
-		}
-		time.Sleep(checkDelay)
+// New creates the Updater of one of the configured services, preparing the local
+// environment and the trusted root metadata.
+func New(cfg *Config, svc *ServiceConfig, log metadata.Logger, opts ...Option) (*Updater, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
 	}
+	metadataDir, err := InitEnvironment(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize environment: %w", err)
+	}
+	if err := InitTrustedRoot(cfg, metadataDir); err != nil {
+		return nil, fmt.Errorf("failed to initialize the trusted root: %w", err)
+	}
+	if err := os.MkdirAll(svc.InstallDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create the install folder of %s: %w", svc.Name, err)
+	}
+	u := &Updater{cfg: cfg, svc: svc, log: log, metadataDir: metadataDir}
+	for _, opt := range opts {
+		opt(u)
+	}
+	return u, nil
+}
+
+// Service returns the configuration of the service kept updated.
+func (u *Updater) Service() *ServiceConfig {
+	return u.svc
 }
 
-// InitEnvironment, InitTrustOnFirstUse, DownloadTargetIndex and setUpdateStatus
-// are similar to your original updater functions. You can place them here or split them into
-// multiple files if desired.
+// Check refreshes the TUF metadata and the service index and reports whether
+// the indexed release is newer than the installed one.
+func (u *Updater) Check(ctx context.Context) (res *CheckResult, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	defer func() { u.recordCheck(res, err) }()
 
-func InitEnvironment() (string, error) {
-	cwd, err := os.Getwd()
+	if err := ctx.Err(); err != nil {
+		return nil, u.error(PhaseCheck, err)
+	}
+	content, cached, err := DownloadTargetIndex(u.cfg, u.svc, u.metadataDir, u.fetcher)
 	if err != nil {
-		return "", fmt.Errorf("failed to get working directory: %w", err)
+		return nil, u.error(PhaseCheck, err)
+	}
+	index, err := parseIndex(u.svc.Name, content)
+	if err != nil {
+		return nil, u.error(PhaseCheck, err)
+	}
+	available, err := ParseVersion(index.Version)
+	if err != nil {
+		return nil, u.error(PhaseCheck, err)
+	}
+	current, err := installedVersion(u.svc)
+	if err != nil {
+		return nil, u.error(PhaseCheck, err)
+	}
+
+	res = &CheckResult{
+		Service:          u.svc.Name,
+		CurrentVersion:   current,
+		Index:            *index,
+		NewIndexDownload: cached == 0,
 	}
-	var tmpDir string
-	if !generateRandomFolder {
-		tmpDir = filepath.Join(cwd, "tmp")
-		os.Mkdir(tmpDir, 0750)
+	if current == "" {
+		res.UpdateAvailable = true
+	} else if installed, err := ParseVersion(current); err != nil {
+		// Installed by hand outside of the release process: any release replaces it
+		res.UpdateAvailable = true
+	} else if available.Compare(installed) == 0 && !available.SameCommit(installed) {
+		return nil, u.error(PhaseCheck, fmt.Errorf("%w: %s, installed %s", ErrVersionConflict, available, installed))
 	} else {
-		tmpDir, err = os.MkdirTemp(cwd, "tmp")
+		res.UpdateAvailable = available.Newer(installed)
+		res.Downgrade = installed.Newer(available)
+		if u.allowDowngrade && res.Downgrade {
+			res.UpdateAvailable = true
+		}
+	}
+
+	// Staged rollouts only gate the releases fetched from the repository,
+	// not the ones an operator brings in a bundle or rolls back to.
+	if res.UpdateAvailable && !res.Downgrade && u.bundle == nil {
+		machineID, err := readMachineID(u.cfg.MachineIDFile)
 		if err != nil {
-			return "", fmt.Errorf("failed to create a temporary folder: %w", err)
+			return nil, u.error(PhaseCheck, err)
 		}
+		eligible, err := rolloutEligible(index, machineID, time.Now())
+		if err != nil {
+			return nil, u.error(PhaseCheck, err)
+		}
+		res.UpdateAvailable = eligible
+		res.RolloutDeferred = !eligible
 	}
-	os.Mkdir(filepath.Join(cwd, "data"), 0750)
-	return tmpDir, nil
+	return res, nil
 }
 
-func InitTrustOnFirstUse(metadataDir string) error {
-	rootPath := filepath.Join(metadataDir, "root.json")
-	if _, err := os.Stat(rootPath); err == nil {
-		return nil
+// Download fetches the artifact of the checked release into the staging area, resuming a
+// previous partial download of the same artifact and hashing it while streaming.
+func (u *Updater) Download(ctx context.Context, checked *CheckResult) (*DownloadResult, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if checked == nil {
+		return nil, u.error(PhaseDownload, ErrOutOfOrder)
 	}
-	rootURL, err := url.JoinPath(metadataURL, "1.root.json")
+	index := checked.Index
+	if !validSHA256(index.Hashes.Sha256) {
+		return nil, u.error(PhaseDownload, fmt.Errorf("invalid artifact hash %q in the index", index.Hashes.Sha256))
+	}
+
+	path := u.svc.DownloadPath(index.Hashes.Sha256)
+	u.removeStalePartials(path)
+
+	size, target, open, err := u.artifactSource(&index)
 	if err != nil {
-		return fmt.Errorf("failed to create URL for 1.root.json: %w", err)
+		return nil, u.error(PhaseDownload, err)
 	}
-	resp, err := http.Get(rootURL)
+	// The artifact of a bundle was hashed while extracting it, so it is moved rather than copied
+	if u.bundle != nil {
+		if hash, ok := u.bundle.take(u.bundle.artifactFile(u.svc.Name, target), path, size); ok {
+			u.setProgress(size, size)
+			return &DownloadResult{Path: path, index: index, hash: hash, target: target}, nil
+		}
+	}
+	hash, err := stageArtifact(ctx, path, size, progressOpener(open, func(done int64) { u.setProgress(done, size) }))
 	if err != nil {
-		return fmt.Errorf("failed to GET 1.root.json: %w", err)
+		return nil, u.error(PhaseDownload, err)
 	}
-	defer resp.Body.Close()
-	data, err := io.ReadAll(resp.Body)
+	return &DownloadResult{Path: path, index: index, hash: hash, target: target}, nil
+}
+
+// artifactSource returns the length of the artifact of index, its TUF target if any and how
+// to open it. Artifacts published as TUF targets take their length and hash from the signed
+// targets metadata; the others, and the targets that are not published, are fetched from the
+// index path or the bundle.
+func (u *Updater) artifactSource(index *IndexInfo) (int64, *ArtifactTarget, openFunc, error) {
+	if u.svc.ArtifactTarget != "" {
+		target, err := GetArtifactTarget(u.cfg, u.svc, u.metadataDir, u.fetcher, u.svc.artifactTargetPath(index.Version))
+		switch {
+		case err == nil:
+			u.log.Info("Downloading target artifact", "service", u.svc.Name, "version", index.Version, "target", target.Path, "bytes", target.Length)
+			if u.bundle != nil {
+				return target.Length, target, fileOpener(u.bundle.targetPath(target.RemotePath)), nil
+			}
+			return target.Length, target, httpOpener(ensureTrailingSlash(u.cfg.TargetsURL) + target.RemotePath), nil
+		case errors.Is(err, ErrTargetNotFound):
+			u.log.Info("Artifact is not a TUF target, falling back to its index path", "service", u.svc.Name, "version", index.Version)
+		default:
+			return 0, nil, nil, err
+		}
+	}
+
+	size, err := artifactSize(index)
 	if err != nil {
-		return fmt.Errorf("failed to read 1.root.json body: %w", err)
+		return 0, nil, nil, err
+	}
+	if u.bundle != nil {
+		u.log.Info("Copying artifact from the bundle", "service", u.svc.Name, "version", index.Version)
+		return size, nil, fileOpener(u.bundle.artifactPath(u.svc.Name)), nil
+	}
+	open, err := u.cfg.artifactOpener(index.Path)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	u.log.Info("Downloading artifact", "service", u.svc.Name, "version", index.Version, "location", index.Path, "bytes", size)
+	return size, nil, open, nil
+}
+
+// removeStalePartials deletes the partial downloads of the service other than keep,
+// left behind by releases that were superseded before being downloaded.
+func (u *Updater) removeStalePartials(keep string) {
+	partials, _ := filepath.Glob(filepath.Join(filepath.Dir(keep), u.svc.Name+"-*.zip.part"))
+	for _, partial := range partials {
+		if partial != keep {
+			os.Remove(partial)
+		}
+	}
+}
+
+// Verify checks the hash of the downloaded artifact, computed while downloading it, against
+// the hash of the index and, for TUF targets, of the targets metadata. Then it moves the
+// artifact out of the staging area next to the installed versions. TUF targets are also kept
+// in the targets folder, laid out as in the remote repository, for the mirror to serve them.
+func (u *Updater) Verify(ctx context.Context, downloaded *DownloadResult) (*VerifyResult, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if downloaded == nil {
+		return nil, u.error(PhaseVerify, ErrOutOfOrder)
 	}
-	return os.WriteFile(rootPath, data, 0644)
+	if err := ctx.Err(); err != nil {
+		return nil, u.error(PhaseVerify, err)
+	}
+	hash := downloaded.hash
+	var targetHash string
+	if downloaded.target != nil {
+		targetHash = downloaded.target.SHA256
+	}
+	for _, expected := range []string{downloaded.index.Hashes.Sha256, targetHash} {
+		if expected == "" || hash == expected {
+			continue
+		}
+		os.Remove(downloaded.Path)
+		return nil, u.error(PhaseVerify, fmt.Errorf("%w: expected %s, got %s", ErrHashMismatch, expected, hash))
+	}
+
+	path := u.svc.ArchivePath()
+	if err := os.Rename(downloaded.Path, path); err != nil {
+		return nil, u.error(PhaseVerify, fmt.Errorf("failed to move the artifact: %w", err))
+	}
+	if downloaded.target != nil {
+		if err := u.keepTarget(path, downloaded.target); err != nil {
+			u.log.Error(err, "Error keeping the target artifact for the mirror", "service", u.svc.Name, "target", downloaded.target.RemotePath)
+		}
+	}
+	u.log.Info("✅ Artifact verified", "service", u.svc.Name, "sha256", hash)
+	return &VerifyResult{Path: path, SHA256: hash, Version: downloaded.index.Version}, nil
 }
 
-func DownloadTargetIndex(metadataDir, service string) ([]byte, int, error) {
-	serviceFilePath := filepath.Join(service, fmt.Sprintf("%s-index.json", service))
-	fmt.Printf("DEBUG: serviceFilePath: %s\n", serviceFilePath)
-	rootBytes, err := os.ReadFile(filepath.Join(metadataDir, "root.json"))
+// Install unzips the verified artifact into its version folder. It is unzipped next to it and
+// renamed once complete, so that a failed install never touches an existing folder. A version
+// already on disk, as after a rollback, is kept as it is.
+func (u *Updater) Install(ctx context.Context, verified *VerifyResult) (*InstallResult, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if verified == nil {
+		return nil, u.error(PhaseInstall, ErrOutOfOrder)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, u.error(PhaseInstall, err)
+	}
+	previous, err := installedVersion(u.svc)
 	if err != nil {
-		return nil, 0, err
+		return nil, u.error(PhaseInstall, err)
+	}
+	dir := u.svc.VersionDir(verified.Version)
+	_, statErr := os.Stat(dir)
+	retained := statErr == nil
+	if err := writeJournal(u.svc, &journal{Version: verified.Version, PreviousVersion: previous, Step: stepInstalling, Retained: retained}); err != nil {
+		return nil, u.error(PhaseInstall, err)
+	}
+	if retained {
+		u.log.Info("Release already installed, keeping it", "service", u.svc.Name, "dir", dir)
+	} else if err := u.unzipVersion(verified.Path, verified.Version); err != nil {
+		clearJournal(u.svc)
+		return nil, u.error(PhaseInstall, err)
+	}
+	os.Remove(verified.Path)
+	u.log.Info("✅ Release installed", "service", u.svc.Name, "dir", dir)
+	return &InstallResult{Version: verified.Version, Dir: dir, retained: retained}, nil
+}
+
+// unzipVersion unzips the artifact into the partial folder of the version and renames it
+// into place once synced.
+func (u *Updater) unzipVersion(artifact, version string) error {
+	part := u.svc.partialVersionDir(version)
+	// Left behind by an interrupted install of the same version
+	if err := os.RemoveAll(part); err != nil {
+		return err
+	}
+	if err := Unzip(artifact, part); err != nil {
+		os.RemoveAll(part)
+		return fmt.Errorf("failed to unzip the artifact: %w", err)
+	}
+	if err := syncDir(part); err != nil {
+		os.RemoveAll(part)
+		return err
+	}
+	if err := os.Rename(part, u.svc.VersionDir(version)); err != nil {
+		os.RemoveAll(part)
+		return fmt.Errorf("failed to move the version folder: %w", err)
 	}
-	cfg, err := config.New(metadataURL, rootBytes)
+	return syncDir(u.svc.InstallDir)
+}
+
+// Activate points the links of the service to the installed version and restarts the unit.
+// Once the new version is confirmed healthy, the versions older than the one that was running
+// are deleted. If it is not, the links are pointed back to the previous version, the unit is
+// restarted again and the failure is recorded in the history of the service.
+func (u *Updater) Activate(ctx context.Context, installed *InstallResult) (*ActivateResult, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if installed == nil {
+		return nil, u.error(PhaseActivate, ErrOutOfOrder)
+	}
+	version := installed.Version
+	previous, err := installedVersion(u.svc)
 	if err != nil {
-		return nil, 0, err
+		return nil, u.error(PhaseActivate, err)
+	}
+
+	j := &journal{Version: version, PreviousVersion: previous, Step: stepSwitching, Retained: installed.retained}
+	if err := writeJournal(u.svc, j); err != nil {
+		return nil, u.error(PhaseActivate, err)
+	}
+	if err := u.switchTo(ctx, version, j); err != nil {
+		return nil, u.error(PhaseActivate, u.rollback(ctx, version, previous, installed.retained, err))
+	}
+	u.log.Info("Service restarted, checking its health", "unit", u.svc.Unit, "version", version)
+
+	if err := waitHealthy(ctx, u.svc, u.cfg.HealthTimeout, u.cfg.HealthStablePeriod); err != nil {
+		if ctx.Err() != nil {
+			// Shutting down: the previous version is kept, nothing is rolled back.
+			return nil, u.error(PhaseHealth, err)
+		}
+		return nil, u.error(PhaseHealth, u.rollback(ctx, version, previous, installed.retained, err))
+	}
+	u.log.Info("✅ Service healthy", "unit", u.svc.Unit, "version", version)
+	if err := writeJournal(u.svc, &journal{Version: version, PreviousVersion: previous, Step: stepCommitted}); err != nil {
+		return nil, u.error(PhaseActivate, err)
+	}
+	u.record(HistoryEntry{Version: version, PreviousVersion: previous, Result: ResultInstalled})
+
+	result := &ActivateResult{Version: version, PreviousVersion: previous}
+	result.Removed = u.prune(version, previous)
+	if err := clearJournal(u.svc); err != nil {
+		return nil, u.error(PhaseActivate, err)
 	}
-	cwd, err := os.Getwd()
+	return result, nil
+}
+
+// prune deletes the versions of the service the retention policy does not keep, besides
+// the active one and the fallback, and updates the inventory.
+func (u *Updater) prune(active, fallback string) []string {
+	removed, err := prune(u.svc, u.cfg.retention(u.svc), active, fallback, time.Now())
 	if err != nil {
-		return nil, 0, err
+		u.log.Error(err, "Error deleting old versions", "service", u.svc.Name)
+	}
+	if len(removed) > 0 {
+		u.log.Info("Old versions deleted", "service", u.svc.Name, "versions", removed)
+	}
+	for _, version := range removed {
+		u.removeTargets(version)
 	}
-	cfg.LocalMetadataDir = metadataDir
-	cfg.LocalTargetsDir = filepath.Join(cwd, "data")
-	cfg.RemoteTargetsURL = targetsURL
-	cfg.PrefixTargetsWithHash = true
+	u.writeInventory()
+	return removed
+}
 
-	up, err := updater.New(cfg)
+// keepTarget links the verified artifact into the targets folder at the remote path of its
+// target, hash-prefixed with consistent snapshots, copying it when it cannot be linked.
+func (u *Updater) keepTarget(artifact string, target *ArtifactTarget) error {
+	dest := filepath.Join(u.cfg.TargetsDir(), filepath.FromSlash(target.RemotePath))
+	if _, err := os.Stat(dest); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0750); err != nil {
+		return err
+	}
+	if err := os.Link(artifact, dest); err == nil {
+		return nil
+	}
+	src, err := os.Open(artifact)
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to create updater: %w", err)
+		return err
+	}
+	defer src.Close()
+	part := dest + ".part"
+	out, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, src); err != nil {
+		out.Close()
+		os.Remove(part)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(part)
+		return err
+	}
+	return os.Rename(part, dest)
+}
+
+// removeTargets deletes the target artifacts of a version kept for the mirror, whether
+// hash-prefixed or not.
+func (u *Updater) removeTargets(version string) {
+	if u.svc.ArtifactTarget == "" {
+		return
+	}
+	dir, base := filepath.Split(filepath.Join(u.cfg.TargetsDir(), filepath.FromSlash(u.svc.artifactTargetPath(version))))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		hash, name, prefixed := strings.Cut(entry.Name(), ".")
+		if entry.Name() != base && (!prefixed || name != base || !validSHA256(hash)) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			u.log.Error(err, "Error deleting the target artifact", "version", version, "file", entry.Name())
+		}
+	}
+}
+
+// writeInventory updates the inventory file, logging the failures.
+func (u *Updater) writeInventory() {
+	if err := WriteInventory(u.cfg); err != nil {
+		u.log.Error(err, "Error writing the inventory", "service", u.svc.Name)
+	}
+}
+
+// switchTo points the links of the service to the given version and restarts the unit. The
+// journal of the transaction records the restart before it happens, so that Recover knows
+// whether the unit runs the version of the links.
+func (u *Updater) switchTo(ctx context.Context, version string, j *journal) error {
+	dir := u.svc.VersionDir(version)
+	for _, link := range u.svc.Links {
+		if err := updateSymlink(filepath.Join(dir, filepath.FromSlash(link.Target)), link.Name); err != nil {
+			return err
+		}
+	}
+	j.Restarted = true
+	if err := writeJournal(u.svc, j); err != nil {
+		return err
+	}
+	return reloadAndRestartUnit(ctx, u.svc.Unit)
+}
+
+// rollback goes back to the previous version after the failed one did not pass its health
+// check, and deletes the failed version unless it was retained. It returns the error to report.
+func (u *Updater) rollback(ctx context.Context, failed, previous string, retained bool, cause error) error {
+	u.log.Error(cause, "❌ New version is not healthy, rolling back", "service", u.svc.Name, "version", failed, "previous", previous)
+
+	if previous == "" {
+		u.record(HistoryEntry{Version: failed, Result: ResultFailed, Error: cause.Error()})
+		clearJournal(u.svc)
+		return fmt.Errorf("%w: no previous version to roll back to", cause)
+	}
+	// Restarting the unit may stop the updater running in it: the next start then finishes the rollback
+	j := &journal{Version: failed, PreviousVersion: previous, Step: stepRollingBack, Retained: retained}
+	if err := writeJournal(u.svc, j); err != nil {
+		u.log.Error(err, "Error writing the install journal", "service", u.svc.Name)
 	}
-	if err = up.Refresh(); err != nil {
-		return nil, 0, fmt.Errorf("failed to refresh metadata: %w", err)
+	if err := u.switchTo(ctx, previous, j); err != nil {
+		// The journal is kept, so the rollback is retried when the daemon starts again.
+		err = fmt.Errorf("%w: rollback to %s failed: %w", cause, previous, err)
+		u.record(HistoryEntry{Version: failed, PreviousVersion: previous, Result: ResultFailed, Error: err.Error()})
+		return err
+	}
+	if err := clearJournal(u.svc); err != nil {
+		u.log.Error(err, "Error clearing the install journal", "service", u.svc.Name)
+	}
+	if !retained {
+		if err := os.RemoveAll(u.svc.VersionDir(failed)); err != nil {
+			u.log.Error(err, "Error deleting the failed version folder", "version", failed)
+		}
+		u.removeTargets(failed)
+	}
+	u.log.Info("↩️ Rolled back", "service", u.svc.Name, "version", previous)
+	u.writeInventory()
+	u.record(HistoryEntry{Version: failed, PreviousVersion: previous, Result: ResultRolledBack, Error: cause.Error()})
+	return fmt.Errorf("%w: rolled back to %s", cause, previous)
+}
+
+// record appends an entry to the history of the service, logging the failures.
+func (u *Updater) record(entry HistoryEntry) {
+	if err := appendHistory(u.svc, entry); err != nil {
+		u.log.Error(err, "Error recording the update history", "service", u.svc.Name)
+	}
+}
+
+// Apply checks for a new release and runs the Download, Verify, Install and Activate phases.
+// It returns ErrNoUpdate when the installed version is already the latest one.
+func (u *Updater) Apply(ctx context.Context) (*ActivateResult, error) {
+	res, err := u.apply(ctx)
+	if err != nil && !errors.Is(err, ErrNoUpdate) {
+		u.recordError(err)
+	}
+	return res, err
+}
+
+func (u *Updater) apply(ctx context.Context) (*ActivateResult, error) {
+	unlock, err := lockService(u.svc)
+	if err != nil {
+		return nil, u.error(PhaseCheck, err)
+	}
+	defer unlock()
+
+	// The update can be cancelled until the release starts to be installed
+	cancelCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	u.startApply(cancel)
+	defer u.endApply()
+
+	res, err := u.Check(cancelCtx)
+	if err != nil {
+		return nil, err
+	}
+	if !res.UpdateAvailable {
+		if res.RolloutDeferred {
+			return nil, u.error(PhaseCheck, fmt.Errorf("%w: %s is not rolled out to this machine yet", ErrNoUpdate, res.Index.Version))
+		}
+		if res.Downgrade {
+			return nil, u.error(PhaseCheck, fmt.Errorf("%w: %s is older than %s", ErrDowngrade, res.Index.Version, res.CurrentVersion))
+		}
+		return nil, u.error(PhaseCheck, ErrNoUpdate)
 	}
-	ti, err := up.GetTargetInfo(serviceFilePath)
+	u.setRelease(res.Index.Version)
+	u.setPhase(PhaseDownload)
+	downloaded, err := u.Download(cancelCtx, res)
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to get target info: %w", err)
+		return nil, err
 	}
-	os.Mkdir(filepath.Join(cwd, "data", service), 0750)
-	targetPath := filepath.Join(cwd, "data", service, fmt.Sprintf("%s-index.json", service))
-	os.MkdirAll(filepath.Dir(targetPath), 0750)
-	path, tb, err := up.FindCachedTarget(ti, targetPath)
-	fmt.Printf("DEBUG: Cached target file: %s\n", path)
+	u.setPhase(PhaseVerify)
+	verified, err := u.Verify(cancelCtx, downloaded)
 	if err != nil {
-		return nil, 0, fmt.Errorf("error checking cache: %w", err)
+		return nil, err
 	}
-	if path != "" {
-		fmt.Println("CACHE HIT")
-		return tb, 1, nil
+	if !u.commitApply() {
+		return nil, u.error(PhaseInstall, ErrCanceled)
+	}
+	installed, err := u.Install(ctx, verified)
+	if err != nil {
+		return nil, err
+	}
+	u.setPhase(PhaseActivate)
+	return u.Activate(ctx, installed)
+}
+
+func (u *Updater) error(phase Phase, err error) error {
+	return &Error{Phase: phase, Service: u.svc.Name, Err: err}
+}
+
+// serviceLocks holds a mutex per service so that the updates applied from the
+// daemon and from bundles never run at the same time on one service.
+var serviceLocks sync.Map
+
+// ServiceLockFileName is the name of the lock file in the install folder of a service, locked
+// while the service is updated or rolled back so that the CLI commands running in another
+// process wait for the daemon.
+const ServiceLockFileName = ".update.lock"
+
+// lockService serializes the updates of the service, within the process with a mutex and
+// across processes with the lock file of the service.
+func lockService(svc *ServiceConfig) (func(), error) {
+	mu, _ := serviceLocks.LoadOrStore(svc.Name, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	unlock, err := lockFile(filepath.Join(svc.InstallDir, ServiceLockFileName))
+	if err != nil {
+		mu.(*sync.Mutex).Unlock()
+		return nil, err
 	}
-	_, tb, err = up.DownloadTarget(ti, targetPath, "")
+	return func() {
+		unlock()
+		mu.(*sync.Mutex).Unlock()
+	}, nil
+}
+
+// SetupLogging sends the go-tuf and updater logs to both stdout and the log file.
+// The returned file must be closed once the updater is done.
+func SetupLogging(cfg *Config) (metadata.Logger, io.Closer, error) {
+	logFile, err := os.OpenFile(cfg.LogFilePath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to download target index: %w", err)
+		return nil, nil, fmt.Errorf("failed to open log file: %w", err)
 	}
-	return tb, 0, nil
+	metadata.SetLogger(stdr.New(stdlog.New(io.MultiWriter(os.Stdout, logFile), "updater: ", stdlog.LstdFlags)))
+	stdr.SetVerbosity(cfg.Verbosity)
+	return metadata.GetLogger(), logFile, nil
 }
 
-func setUpdateStatus(value int) error {
-	status := UpdateStatus{UpdateAvailable: value}
-	data, err := json.MarshalIndent(status, "", "  ")
+// Run executes the updater daemon: for every configured service it periodically
+// checks for new releases and applies them when the user requests the update.
+// Each service is checked and updated on its own.
+func Run(ctx context.Context, cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	services, err := cfg.LoadServices()
+	if err != nil {
+		return err
+	}
+
+	log, logFile, err := SetupLogging(cfg)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	var updaters []*Updater
+	for _, svc := range services {
+		u, err := New(cfg, svc, log)
+		if err != nil {
+			log.Error(err, "Failed to initialize the updater", "service", svc.Name)
+			return err
+		}
+		if err := u.Recover(ctx); err != nil {
+			log.Error(err, "❌ Failed to recover the interrupted install", "service", svc.Name)
+			return err
+		}
+		if active, err := installedVersion(svc); err == nil {
+			u.prune(active, "")
+		}
+		updaters = append(updaters, u)
+	}
+
+	schedule, err := cfg.Schedule()
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(jsonPath, data, 0644)
+
+	var wg sync.WaitGroup
+	for _, u := range updaters {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			u.checkLoop(ctx, cfg.CheckInterval, cfg.CheckJitter)
+		}()
+		go func() {
+			defer wg.Done()
+			u.applyLoop(ctx, cfg.PollInterval, schedule)
+		}()
+	}
+
+	if err := os.MkdirAll(cfg.BundleDir, 0750); err != nil {
+		return fmt.Errorf("failed to create the bundle folder: %w", err)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		bundleLoop(ctx, cfg, cfg.PollInterval, schedule, log)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		rollbackLoop(ctx, cfg, updaters, cfg.PollInterval, log)
+	}()
+
+	if cfg.ControlSocket != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := runControl(ctx, cfg, updaters, log); err != nil {
+				log.Error(err, "❌ Control API stopped")
+			}
+		}()
+	}
+
+	if cfg.MirrorAddr != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := runMirror(ctx, cfg, log); err != nil {
+				log.Error(err, "❌ Mirror stopped")
+			}
+		}()
+	}
+
+	wg.Wait()
+	return ctx.Err()
+}
+
+// checkLoop checks for updates every interval plus a random jitter.
+func (u *Updater) checkLoop(ctx context.Context, interval, jitter time.Duration) {
+	timer := time.NewTimer(jittered(0, jitter))
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
+
+		u.checkOnce(ctx)
+		timer.Reset(jittered(interval, jitter))
+	}
+}
+
+// checkOnce checks for an update and flags it in the status file of the service,
+// requesting it right away when the auto-update policy covers the release.
+func (u *Updater) checkOnce(ctx context.Context) (*CheckResult, error) {
+	res, err := u.Check(ctx)
+	switch {
+	case err != nil:
+		u.log.Error(err, "Failed to check for updates")
+	case res.UpdateAvailable:
+		automatic, err := u.requestAutoUpdate(res)
+		if err == nil && !automatic {
+			err = setUpdateStatus(u.svc.StatusFile, 1)
+		}
+		switch {
+		case err != nil:
+			u.log.Error(err, "❌ Error updating the status file", "service", u.svc.Name)
+		case automatic:
+			u.log.Info("🤖 Update available, installing it automatically", "service", u.svc.Name, "channel", u.svc.Channel, "current", res.CurrentVersion, "available", res.Index.Version)
+		default:
+			u.log.Info("🔄 Update available", "service", u.svc.Name, "channel", u.svc.Channel, "current", res.CurrentVersion, "available", res.Index.Version)
+		}
+	case res.RolloutDeferred:
+		u.log.Info("⏳ Release not rolled out to this machine yet", "service", u.svc.Name, "current", res.CurrentVersion, "available", res.Index.Version)
+	case res.Downgrade:
+		u.log.Info("⚠️ The indexed release is older than the installed one, it will not be installed", "service", u.svc.Name, "current", res.CurrentVersion, "indexed", res.Index.Version)
+	default:
+		u.log.Info("The installed version is the most updated one", "service", u.svc.Name, "version", res.CurrentVersion)
+	}
+	return res, err
+}
+
+// applyLoop reads the status file of the service whenever it changes, and every interval, and applies the
+// update when the user, or the auto-update mode, requests it.
+// Requests made outside the maintenance windows are queued until the next window opens, which is written to
+// the status file so that the UI can show when the update will run. The automatic updates are only queued
+// with the window policy.
+func (u *Updater) applyLoop(ctx context.Context, interval time.Duration, schedule *Schedule) {
+	w := newWaiter(ctx, interval, u.log, u.svc.StatusFile)
+	defer w.stop()
+	for w.wait(ctx) {
+
+		status, err := readUpdateStatus(u.svc.StatusFile)
+		if err != nil {
+			u.log.Error(err, "There has been an error while reading the update requested value", "service", u.svc.Name)
+			continue
+		}
+		if status.UpdateRequested != 1 {
+			continue
+		}
+
+		now := time.Now()
+		if u.cfg.waitsForWindow(status) && !schedule.Open(now) {
+			u.queue(status, schedule, now)
+			continue
+		}
+
+		res, err := u.Apply(ctx)
+		switch {
+		case errors.Is(err, ErrCanceled) || errors.Is(err, context.Canceled) && ctx.Err() == nil:
+			u.log.Info("🛑 Update cancelled", "service", u.svc.Name)
+		case err != nil:
+			u.log.Error(err, "❌ Update failed")
+		default:
+			u.log.Info("✅ Update applied", "service", u.svc.Name, "version", res.Version, "previous", res.PreviousVersion)
+		}
+		if err != nil && status.AutomaticUpdate == 1 {
+			u.autoUpdateFailed(u.appliedRelease())
+		}
+		// The release stays available when its install failed or was cancelled
+		done := err == nil || errors.Is(err, ErrNoUpdate) || errors.Is(err, ErrDowngrade)
+		if err := updateStatusFile(u.svc.StatusFile, func(s *UpdateStatus) {
+			if done {
+				*s = UpdateStatus{RejectedVersion: s.RejectedVersion}
+				return
+			}
+			s.UpdateRequested, s.AutomaticUpdate, s.ScheduledFor = 0, 0, ""
+		}); err != nil {
+			u.log.Error(err, "❌ Error updating the status file", "service", u.svc.Name)
+		}
+	}
+}
+
+// queue records in the status file when a requested update will be applied.
+func (u *Updater) queue(status UpdateStatus, schedule *Schedule, now time.Time) {
+	next, _ := schedule.NextOpen(now)
+	scheduledFor := next.Format(time.RFC3339)
+	if status.ScheduledFor == scheduledFor {
+		return
+	}
+	if err := updateStatusFile(u.svc.StatusFile, func(s *UpdateStatus) { s.ScheduledFor = scheduledFor }); err != nil {
+		u.log.Error(err, "❌ Error updating the status file", "service", u.svc.Name)
+		return
+	}
+	u.log.Info("🕑 Update requested outside the maintenance windows, queued", "service", u.svc.Name, "scheduled-for", scheduledFor)
 }
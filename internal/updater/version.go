@@ -0,0 +1,87 @@
+package updater
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// versionRegex matches the release tags created by .scripts/make-release.sh:
+// v<YYYY.MM.DD>-sha.<commit>, with a .<sequence> suffix on the date for the
+// second and later releases of the same day, e.g. v2025.03.14.2-sha.1a2b3c4.
+var versionRegex = regexp.MustCompile(`^v(\d{4}\.\d{2}\.\d{2})(?:\.(\d+))?-sha\.([a-fA-F0-9]{7,40})$`)
+
+// ErrDowngrade is returned when the indexed release is older than the installed one
+// and no rollback was requested.
+var ErrDowngrade = errors.New("release is older than the installed version")
+
+// ErrVersionConflict is returned when the indexed release has the date and sequence of the
+// installed one but another commit, so that neither is newer.
+var ErrVersionConflict = errors.New("release has the date and sequence of the installed version but another commit")
+
+// Version is a parsed release tag. Versions are ordered by date and then by sequence;
+// the commit only identifies the release.
+type Version struct {
+	Date     time.Time
+	Sequence int
+	SHA      string
+
+	tag string
+}
+
+// ParseVersion parses a release tag.
+func ParseVersion(tag string) (Version, error) {
+	m := versionRegex.FindStringSubmatch(tag)
+	if m == nil {
+		return Version{}, fmt.Errorf("invalid version %q: must be v<YYYY.MM.DD>[.<seq>]-sha.<commit>", tag)
+	}
+	date, err := time.Parse("2006.01.02", m[1])
+	if err != nil {
+		return Version{}, fmt.Errorf("invalid version %q: %w", tag, err)
+	}
+	var seq int
+	if m[2] != "" {
+		if seq, err = strconv.Atoi(m[2]); err != nil {
+			return Version{}, fmt.Errorf("invalid version %q: %w", tag, err)
+		}
+	}
+	return Version{Date: date, Sequence: seq, SHA: m[3], tag: tag}, nil
+}
+
+// String returns the release tag.
+func (v Version) String() string {
+	return v.tag
+}
+
+// Compare returns -1, 0 or +1 depending on whether v is older than, as recent as
+// or newer than w. Versions as recent as each other are only the same release when
+// SameCommit also holds.
+func (v Version) Compare(w Version) int {
+	switch {
+	case v.Date.Before(w.Date):
+		return -1
+	case v.Date.After(w.Date):
+		return 1
+	case v.Sequence < w.Sequence:
+		return -1
+	case v.Sequence > w.Sequence:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Newer reports whether v is a more recent release than w.
+func (v Version) Newer(w Version) bool {
+	return v.Compare(w) > 0
+}
+
+// SameCommit reports whether v and w were built from the same commit, possibly abbreviated
+// to different lengths.
+func (v Version) SameCommit(w Version) bool {
+	n := min(len(v.SHA), len(w.SHA))
+	return strings.EqualFold(v.SHA[:n], w.SHA[:n])
+}
@@ -0,0 +1,85 @@
+package updater
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		tag  string
+		date time.Time
+		seq  int
+		sha  string
+		ok   bool
+	}{
+		{"v2025.03.14-sha.1a2b3c4", time.Date(2025, 3, 14, 0, 0, 0, 0, time.UTC), 0, "1a2b3c4", true},
+		{"v2025.03.14.2-sha.1a2b3c4", time.Date(2025, 3, 14, 0, 0, 0, 0, time.UTC), 2, "1a2b3c4", true},
+		{"v2025.12.31.10-sha.1A2B3C4D5E6F7A8B9C0D1E2F3A4B5C6D7E8F9A0B", time.Date(2025, 12, 31, 0, 0, 0, 0, time.UTC), 10, "1A2B3C4D5E6F7A8B9C0D1E2F3A4B5C6D7E8F9A0B", true},
+		{tag: "2025.03.14-sha.1a2b3c4"},
+		{tag: "v2025.3.14-sha.1a2b3c4"},
+		{tag: "v2025.13.01-sha.1a2b3c4"},
+		{tag: "v2025.02.30-sha.1a2b3c4"},
+		{tag: "v2025.03.14-sha.1a2b3"},
+		{tag: "v2025.03.14-sha.1a2b3cz"},
+		{tag: "v2025.03.14.-sha.1a2b3c4"},
+		{tag: "v2025.03.14-sha.1a2b3c4-dirty"},
+		{tag: "latest"},
+	}
+	for _, tt := range tests {
+		v, err := ParseVersion(tt.tag)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("ParseVersion(%q) accepted an invalid tag", tt.tag)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseVersion(%q) = %v", tt.tag, err)
+			continue
+		}
+		if !v.Date.Equal(tt.date) || v.Sequence != tt.seq || v.SHA != tt.sha || v.String() != tt.tag {
+			t.Errorf("ParseVersion(%q) = %+v", tt.tag, v)
+		}
+	}
+}
+
+func TestVersionCompare(t *testing.T) {
+	tests := []struct {
+		v, w string
+		want int
+		same bool
+	}{
+		{"v2025.03.14-sha.1a2b3c4", "v2025.03.14-sha.1a2b3c4", 0, true},
+		{"v2025.03.14-sha.1a2b3c4", "v2025.03.14-sha.1A2B3C4D5E", 0, true},
+		{"v2025.03.14-sha.1a2b3c4", "v2025.03.14-sha.5d6e7f8", 0, false},
+		{"v2025.03.14-sha.1a2b3c4", "v2025.03.14.2-sha.5d6e7f8", -1, false},
+		{"v2025.03.14.10-sha.1a2b3c4", "v2025.03.14.9-sha.5d6e7f8", 1, false},
+		{"v2025.03.14.5-sha.1a2b3c4", "v2025.03.15-sha.5d6e7f8", -1, false},
+		{"v2026.01.01-sha.1a2b3c4", "v2025.12.31.3-sha.5d6e7f8", 1, false},
+	}
+	for _, tt := range tests {
+		v, err := ParseVersion(tt.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := ParseVersion(tt.w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := v.Compare(w); got != tt.want {
+			t.Errorf("%s.Compare(%s) = %d, want %d", tt.v, tt.w, got, tt.want)
+		}
+		if got := w.Compare(v); got != -tt.want {
+			t.Errorf("%s.Compare(%s) = %d, want %d", tt.w, tt.v, got, -tt.want)
+		}
+		if got := v.Newer(w); got != (tt.want > 0) {
+			t.Errorf("%s.Newer(%s) = %v", tt.v, tt.w, got)
+		}
+		if tt.want == 0 {
+			if got := v.SameCommit(w); got != tt.same {
+				t.Errorf("%s.SameCommit(%s) = %v, want %v", tt.v, tt.w, got, tt.same)
+			}
+		}
+	}
+}
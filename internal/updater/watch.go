@@ -0,0 +1,151 @@
+package updater
+
+import (
+	"context"
+	"math/rand/v2"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// events is the in-process publisher of the changes made by the updater, so that a server
+// running in the same process learns them without watching the files. Each file, and the
+// status as a whole, is a topic of its own, so that a loop waiting for a file is not woken
+// up by the progress of a download.
+var events = &broker{subs: map[string]map[chan struct{}]struct{}{}}
+
+// statusTopic is the topic of the status changes, see SubscribeStatus.
+const statusTopic = "status"
+
+type broker struct {
+	mu   sync.Mutex
+	subs map[string]map[chan struct{}]struct{}
+}
+
+// subscribe returns a channel notified when one of the topics is published, and the
+// function unsubscribing it.
+func (b *broker) subscribe(topics ...string) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, topic := range topics {
+		if b.subs[topic] == nil {
+			b.subs[topic] = map[chan struct{}]struct{}{}
+		}
+		b.subs[topic][ch] = struct{}{}
+	}
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for _, topic := range topics {
+			delete(b.subs[topic], ch)
+			if len(b.subs[topic]) == 0 {
+				delete(b.subs, topic)
+			}
+		}
+	}
+}
+
+// publish notifies the subscribers of topic.
+func (b *broker) publish(topic string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs[topic] {
+		notify(ch)
+	}
+}
+
+// SubscribeStatus returns a channel notified when the status of an update changes: the status
+// file, the install journal, or the phase of a running update. Notifications are coalesced,
+// so subscribers read the status again when notified. The returned function unsubscribes.
+func SubscribeStatus() (<-chan struct{}, func()) {
+	return events.subscribe(statusTopic)
+}
+
+// publishStatus notifies the subscribers of a status change.
+func publishStatus() {
+	events.publish(statusTopic)
+}
+
+// fileTopic is the topic of the changes of the file or folder path.
+func fileTopic(path string) string {
+	return "file:" + filepath.Clean(path)
+}
+
+// publishFile notifies the subscribers of path, and of its folder, that the updater wrote it.
+func publishFile(path string) {
+	events.publish(fileTopic(path))
+	events.publish(fileTopic(filepath.Dir(path)))
+}
+
+// notify sends a notification unless one is already pending.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// WatchFiles returns a channel notified when one of the files changes, or any file of the
+// paths that are folders. Files are watched through their folder, so that they can be
+// created and replaced by a rename. It fails when file events are not supported, in which
+// case the callers poll.
+func WatchFiles(ctx context.Context, paths ...string) (<-chan struct{}, error) {
+	ch := make(chan struct{}, 1)
+	if err := watchFiles(ctx, paths, ch); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// waiter wakes a loop up when the watched files change, on file events or when written by
+// the updater, and every interval in case an event was missed or file events are not supported.
+type waiter struct {
+	ticker      *time.Ticker
+	files       <-chan struct{}
+	written     <-chan struct{}
+	unsubscribe func()
+}
+
+func newWaiter(ctx context.Context, interval time.Duration, log metadata.Logger, paths ...string) *waiter {
+	w := &waiter{ticker: time.NewTicker(interval)}
+	files, err := WatchFiles(ctx, paths...)
+	if err != nil {
+		log.Info("File events unavailable, polling", "paths", paths, "interval", interval, "error", err.Error())
+	}
+	w.files = files
+	topics := make([]string, 0, len(paths))
+	for _, path := range paths {
+		topics = append(topics, fileTopic(path))
+	}
+	w.written, w.unsubscribe = events.subscribe(topics...)
+	return w
+}
+
+// wait blocks until the next wake up. It returns false when ctx is done.
+func (w *waiter) wait(ctx context.Context) bool {
+	select {
+	case <-w.ticker.C:
+	case <-w.files:
+	case <-w.written:
+	case <-ctx.Done():
+		return false
+	}
+	return true
+}
+
+func (w *waiter) stop() {
+	w.ticker.Stop()
+	w.unsubscribe()
+}
+
+// jittered returns interval plus a random delay up to jitter, so that a fleet started at the
+// same time does not check for updates at the same time.
+func jittered(interval, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	return interval + rand.N(jitter)
+}
@@ -0,0 +1,87 @@
+//go:build linux
+
+package updater
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const watchMask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM | unix.IN_CREATE | unix.IN_DELETE
+
+// watchFiles watches the paths with inotify until ctx is done.
+func watchFiles(ctx context.Context, paths []string, ch chan struct{}) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("failed to initialize inotify: %w", err)
+	}
+	// A non-blocking file is read through the runtime poller, so that closing it ends the read
+	f := os.NewFile(uintptr(fd), "inotify")
+
+	// Names watched in each folder, all of them when nil
+	names := make(map[int32]map[string]bool)
+	for _, path := range paths {
+		dir, name := filepath.Dir(path), filepath.Base(path)
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			dir, name = path, ""
+		}
+		wd, err := unix.InotifyAddWatch(fd, dir, watchMask|unix.IN_ONLYDIR)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("failed to watch %s: %w", dir, err)
+		}
+		set, seen := names[int32(wd)]
+		switch {
+		case name == "":
+			names[int32(wd)] = nil
+		case !seen:
+			names[int32(wd)] = map[string]bool{name: true}
+		case set != nil:
+			set[name] = true
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+	go func() {
+		buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				return
+			}
+			for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+				event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				nameBytes := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(event.Len)]
+				offset += unix.SizeofInotifyEvent + int(event.Len)
+
+				watched, ok := names[event.Wd]
+				if !ok {
+					continue
+				}
+				name := string(nameBytes[:clen(nameBytes)])
+				if watched == nil || watched[name] {
+					notify(ch)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// clen returns the length of the NUL padded name of an inotify event.
+func clen(b []byte) int {
+	for i, c := range b {
+		if c == 0 {
+			return i
+		}
+	}
+	return len(b)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package updater
+
+import (
+	"context"
+	"errors"
+)
+
+// watchFiles is not supported without inotify, the callers poll instead.
+func watchFiles(_ context.Context, _ []string, _ chan struct{}) error {
+	return errors.New("file events are only supported on Linux")
+}
@@ -0,0 +1,41 @@
+package updater
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestFileTopics(t *testing.T) {
+	dir := t.TempDir()
+	statusFile := filepath.Join(dir, "status.json")
+	file, unsubscribeFile := events.subscribe(fileTopic(statusFile))
+	defer unsubscribeFile()
+	folder, unsubscribeFolder := events.subscribe(fileTopic(dir))
+	defer unsubscribeFolder()
+
+	// The progress of a download only notifies the status subscribers
+	publishStatus()
+	select {
+	case <-file:
+		t.Fatal("status change notified the waiter of a file")
+	case <-folder:
+		t.Fatal("status change notified the waiter of a folder")
+	default:
+	}
+
+	publishFile(statusFile)
+	for name, ch := range map[string]<-chan struct{}{"file": file, "folder": folder} {
+		select {
+		case <-ch:
+		default:
+			t.Errorf("writing the status file did not notify the waiter of its %s", name)
+		}
+	}
+
+	publishFile(filepath.Join(dir, "rollback.json"))
+	select {
+	case <-file:
+		t.Error("writing another file notified the waiter of the status file")
+	default:
+	}
+}
@@ -0,0 +1,302 @@
+package updater
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxNextOpen bounds the search of the next opening of a maintenance schedule.
+const maxNextOpen = 366 * 24 * time.Hour
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Schedule is a set of maintenance windows in the site timezone. Updates that restart
+// the services are only applied automatically while one of the windows is open.
+// A schedule without windows is always open.
+type Schedule struct {
+	windows  []window
+	location *time.Location
+}
+
+// window is a single maintenance window, either a weekday and time range or a cron
+// expression with a duration. Times are minutes in the site timezone.
+type window interface {
+	open(t time.Time) bool
+	opens(t time.Time) bool
+}
+
+// ParseSchedule parses the maintenance windows in the timezone tz, e.g. "Local" or
+// "Europe/Madrid". Each window is either
+//
+//	<weekdays> <HH:MM>-<HH:MM>       e.g. "Mon-Fri 02:00-04:00", "Sat,Sun 22:00-06:00" or "* 01:00-03:00"
+//	<cron expression> <duration>     e.g. "30 2 * * 1-5 90m"
+//
+// Time ranges ending before they start cross midnight.
+func ParseSchedule(specs []string, tz string) (*Schedule, error) {
+	location, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %q: %w", tz, err)
+	}
+
+	s := &Schedule{location: location}
+	for _, spec := range specs {
+		var (
+			w   window
+			err error
+		)
+		switch fields := strings.Fields(spec); len(fields) {
+		case 2:
+			w, err = parseWeeklyWindow(fields[0], fields[1])
+		case 6:
+			w, err = parseCronWindow(fields[:5], fields[5])
+		default:
+			err = errors.New("expected \"<weekdays> <HH:MM>-<HH:MM>\" or \"<cron expression> <duration>\"")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid maintenance window %q: %w", spec, err)
+		}
+		if _, ok := (&Schedule{windows: []window{w}, location: location}).NextOpen(time.Now()); !ok {
+			return nil, fmt.Errorf("invalid maintenance window %q: never opens within a year", spec)
+		}
+		s.windows = append(s.windows, w)
+	}
+	return s, nil
+}
+
+// Schedule returns the configured maintenance windows.
+func (c *Config) Schedule() (*Schedule, error) {
+	return ParseSchedule(c.MaintenanceWindows, c.Timezone)
+}
+
+// Always reports whether the schedule has no windows, so that updates are applied at any time.
+func (s *Schedule) Always() bool {
+	return len(s.windows) == 0
+}
+
+// Open reports whether a maintenance window is open at t.
+func (s *Schedule) Open(t time.Time) bool {
+	if s.Always() {
+		return true
+	}
+	t = t.In(s.location).Truncate(time.Minute)
+	for _, w := range s.windows {
+		if w.open(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextOpen returns the time the next maintenance window opens, or t when one is open at t.
+// It returns false when no window opens within a year.
+func (s *Schedule) NextOpen(t time.Time) (time.Time, bool) {
+	if s.Open(t) {
+		return t, true
+	}
+	start := t.In(s.location).Truncate(time.Minute)
+	for next := start.Add(time.Minute); next.Sub(start) <= maxNextOpen; next = next.Add(time.Minute) {
+		for _, w := range s.windows {
+			if w.opens(next) {
+				return next, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// weeklyWindow is open on the given weekdays from start to end, in minutes since midnight.
+// When end is before start the window closes on the next day.
+type weeklyWindow struct {
+	days       [7]bool
+	start, end int
+}
+
+func parseWeeklyWindow(days, hours string) (*weeklyWindow, error) {
+	w := &weeklyWindow{}
+	if days == "*" {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	} else {
+		for _, part := range strings.Split(days, ",") {
+			from, to, isRange := strings.Cut(part, "-")
+			first, ok := weekdays[strings.ToLower(from)]
+			if !ok {
+				return nil, fmt.Errorf("unknown weekday %q", from)
+			}
+			last := first
+			if isRange {
+				if last, ok = weekdays[strings.ToLower(to)]; !ok {
+					return nil, fmt.Errorf("unknown weekday %q", to)
+				}
+			}
+			for d := first; ; d = (d + 1) % 7 {
+				w.days[d] = true
+				if d == last {
+					break
+				}
+			}
+		}
+	}
+
+	from, to, ok := strings.Cut(hours, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid time range %q", hours)
+	}
+	var err error
+	if w.start, err = parseClock(from); err != nil {
+		return nil, err
+	}
+	if w.end, err = parseClock(to); err != nil {
+		return nil, err
+	}
+	if w.start == w.end || w.start == 24*60 {
+		return nil, fmt.Errorf("empty time range %q", hours)
+	}
+	return w, nil
+}
+
+// parseClock parses HH:MM into minutes since midnight, accepting 24:00 as the end of the day.
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hour, err1 := strconv.Atoi(h)
+	minute, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hour < 0 || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return hour*60 + minute, nil
+}
+
+func (w *weeklyWindow) open(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	if w.start < w.end {
+		return w.days[today] && minute >= w.start && minute < w.end
+	}
+	yesterday := (today + 6) % 7
+	return (w.days[today] && minute >= w.start) || (w.days[yesterday] && minute < w.end)
+}
+
+func (w *weeklyWindow) opens(t time.Time) bool {
+	return w.days[t.Weekday()] && t.Hour()*60+t.Minute() == w.start
+}
+
+// cronWindow is open for duration after every minute matching a cron expression.
+type cronWindow struct {
+	minutes, hours, monthDays, months, weekDays []bool
+	anyMonthDay, anyWeekDay                     bool
+	duration                                    time.Duration
+}
+
+func parseCronWindow(fields []string, duration string) (*cronWindow, error) {
+	d, err := time.ParseDuration(duration)
+	if err != nil {
+		return nil, fmt.Errorf("invalid duration %q: %w", duration, err)
+	}
+	if d < time.Minute || d > 7*24*time.Hour {
+		return nil, fmt.Errorf("invalid duration %q: must be between 1m and 168h", duration)
+	}
+
+	w := &cronWindow{
+		duration:    d.Truncate(time.Minute),
+		anyMonthDay: fields[2] == "*",
+		anyWeekDay:  fields[4] == "*",
+	}
+	for _, f := range []struct {
+		set    *[]bool
+		spec   string
+		lo, hi int
+	}{
+		{&w.minutes, fields[0], 0, 59},
+		{&w.hours, fields[1], 0, 23},
+		{&w.monthDays, fields[2], 1, 31},
+		{&w.months, fields[3], 1, 12},
+		{&w.weekDays, fields[4], 0, 7},
+	} {
+		if *f.set, err = parseCronField(f.spec, f.lo, f.hi); err != nil {
+			return nil, err
+		}
+	}
+	// Both 0 and 7 are Sunday
+	if w.weekDays[7] {
+		w.weekDays[0] = true
+	}
+	return w, nil
+}
+
+// parseCronField parses a comma separated list of *, n, a-b, */step or a-b/step.
+func parseCronField(spec string, lo, hi int) ([]bool, error) {
+	set := make([]bool, hi+1)
+	for _, part := range strings.Split(spec, ",") {
+		rng, step, hasStep := strings.Cut(part, "/")
+		every := 1
+		if hasStep {
+			n, err := strconv.Atoi(step)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid step in cron field %q", spec)
+			}
+			every = n
+		}
+
+		first, last := lo, hi
+		if rng != "*" {
+			from, to, isRange := strings.Cut(rng, "-")
+			var err error
+			if first, err = strconv.Atoi(from); err != nil {
+				return nil, fmt.Errorf("invalid cron field %q", spec)
+			}
+			last = first
+			if isRange {
+				if last, err = strconv.Atoi(to); err != nil {
+					return nil, fmt.Errorf("invalid cron field %q", spec)
+				}
+			} else if hasStep {
+				last = hi
+			}
+		}
+		if first < lo || last > hi || first > last {
+			return nil, fmt.Errorf("cron field %q out of range %d-%d", spec, lo, hi)
+		}
+		for v := first; v <= last; v += every {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+// matches reports whether the cron expression matches the minute t. As in cron, when both
+// the day of month and the day of week are restricted, either of them has to match.
+func (w *cronWindow) matches(t time.Time) bool {
+	if !w.minutes[t.Minute()] || !w.hours[t.Hour()] || !w.months[t.Month()] {
+		return false
+	}
+	monthDay, weekDay := w.monthDays[t.Day()], w.weekDays[t.Weekday()]
+	switch {
+	case w.anyMonthDay || w.anyWeekDay:
+		return monthDay && weekDay
+	default:
+		return monthDay || weekDay
+	}
+}
+
+func (w *cronWindow) opens(t time.Time) bool {
+	return w.matches(t)
+}
+
+func (w *cronWindow) open(t time.Time) bool {
+	for start := t; t.Sub(start) < w.duration; start = start.Add(-time.Minute) {
+		if w.matches(start) {
+			return true
+		}
+	}
+	return false
+}
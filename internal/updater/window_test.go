@@ -0,0 +1,108 @@
+package updater
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleOpen(t *testing.T) {
+	// 2025-03-15 is a Saturday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2025, 3, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		spec string
+		t    time.Time
+		want bool
+	}{
+		{"Mon-Fri 02:00-04:00", at(17, 2, 0), true},
+		{"Mon-Fri 02:00-04:00", at(17, 3, 59), true},
+		{"Mon-Fri 02:00-04:00", at(17, 4, 0), false},
+		{"Mon-Fri 02:00-04:00", at(17, 1, 59), false},
+		{"Mon-Fri 02:00-04:00", at(15, 3, 0), false},
+		{"Fri-Mon 02:00-04:00", at(16, 3, 0), true},
+		{"Fri-Mon 02:00-04:00", at(18, 3, 0), false},
+		{"Sat,Sun 22:00-06:00", at(15, 23, 0), true},
+		{"Sat,Sun 22:00-06:00", at(16, 5, 59), true},
+		{"Sat,Sun 22:00-06:00", at(17, 5, 0), true},
+		{"Sat,Sun 22:00-06:00", at(17, 22, 0), false},
+		{"Sat,Sun 22:00-06:00", at(15, 5, 0), false},
+		{"* 01:00-03:00", at(19, 1, 30), true},
+		{"* 22:00-24:00", at(19, 23, 59), true},
+		{"30 2 * * 1-5 90m", at(17, 2, 30), true},
+		{"30 2 * * 1-5 90m", at(17, 3, 59), true},
+		{"30 2 * * 1-5 90m", at(17, 4, 0), false},
+		{"30 2 * * 1-5 90m", at(17, 2, 29), false},
+		{"30 2 * * 1-5 90m", at(15, 2, 45), false},
+		{"0 23 * * 5 2h", at(15, 0, 30), true},
+		{"0 23 * * 5 2h", at(15, 1, 0), false},
+		{"0 */6 * * * 30m", at(19, 12, 15), true},
+		{"0 */6 * * * 30m", at(19, 13, 15), false},
+		{"0 3 * * 7 1h", at(16, 3, 30), true},
+		// Day of month or day of week when both are restricted
+		{"0 3 1 * 0 1h", at(1, 3, 30), true},
+		{"0 3 1 * 0 1h", at(16, 3, 30), true},
+		{"0 3 1 * 0 1h", at(17, 3, 30), false},
+		// Day of month and day of week when one is *
+		{"0 3 1 * * 1h", at(17, 3, 30), false},
+	}
+	for _, tt := range tests {
+		s, err := ParseSchedule([]string{tt.spec}, "UTC")
+		if err != nil {
+			t.Fatalf("ParseSchedule(%q) = %v", tt.spec, err)
+		}
+		if got := s.Open(tt.t); got != tt.want {
+			t.Errorf("%q Open(%s) = %v, want %v", tt.spec, tt.t.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestParseScheduleInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"Mon",
+		"Mon 04:00-04:00",
+		"Mon 24:00-02:00",
+		"Mon 25:00-26:00",
+		"Mon 02:00",
+		"Foo 01:00-02:00",
+		"61 * * * * 1h",
+		"* * * * * 30s",
+		"* * * * * 200h",
+		"*/0 * * * * 1h",
+		"5-1 * * * * 1h",
+		"0 0 30 2 * 1h",
+	} {
+		if _, err := ParseSchedule([]string{spec}, "UTC"); err == nil {
+			t.Errorf("ParseSchedule(%q) accepted an invalid window", spec)
+		}
+	}
+	if _, err := ParseSchedule(nil, "Nowhere/Nothing"); err == nil {
+		t.Error("ParseSchedule() accepted an invalid timezone")
+	}
+}
+
+func TestScheduleNextOpen(t *testing.T) {
+	s, err := ParseSchedule([]string{"Mon-Fri 02:00-04:00"}, "Europe/Madrid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	madrid, _ := time.LoadLocation("Europe/Madrid")
+
+	saturday := time.Date(2025, 3, 15, 10, 0, 0, 0, madrid)
+	next, ok := s.NextOpen(saturday)
+	if want := time.Date(2025, 3, 17, 2, 0, 0, 0, madrid); !ok || !next.Equal(want) {
+		t.Fatalf("NextOpen(%s) = %s, %v, want %s", saturday, next, ok, want)
+	}
+	open := time.Date(2025, 3, 17, 3, 0, 0, 0, madrid)
+	if next, ok := s.NextOpen(open); !ok || !next.Equal(open) {
+		t.Fatalf("NextOpen(%s) = %s, %v, want the same time", open, next, ok)
+	}
+
+	always, err := ParseSchedule(nil, "UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !always.Always() || !always.Open(saturday) {
+		t.Fatal("a schedule without windows is not always open")
+	}
+}